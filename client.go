@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/state"
+)
+
+const (
+	clientRtorrent     = "rtorrent"
+	clientQbittorrent  = "qbittorrent"
+	clientTransmission = "transmission"
+	clientDeluge       = "deluge"
+	clientDirectory    = "directory"
+)
+
+// torrentInfo is a torrent as reported by a client backend.
+type torrentInfo struct {
+	Hash string
+	Name string
+	// remote directory the torrent's files are stored under
+	Path      string
+	Label     string
+	Size      int64
+	Completed bool
+	Finished  time.Time
+	// lay the files out under a directory named after the torrent even if
+	// there is only one
+	MultiFile bool
+}
+
+// torrentFile is one file of a torrent.
+type torrentFile struct {
+	// relative to the torrent's root, as in the metainfo
+	Path string
+	Size int64
+	// absolute path on the remote host
+	Remote string
+}
+
+// torrentClient is the interface to the torrent client on the seedbox.
+type torrentClient interface {
+	syncMarker
+
+	// Torrents lists every torrent known to the client.
+	Torrents() ([]torrentInfo, error)
+	// Files lists the files of a torrent that the client downloads. It sets
+	// MultiFile if the files turn out to be under the torrent's root folder,
+	// which some clients only show in the file names.
+	Files(torrent *torrentInfo) ([]torrentFile, error)
+	// Trackers returns the announce URLs of a torrent.
+	Trackers(torrent torrentInfo) ([]string, error)
+	// Metainfo opens the torrent's .torrent file.
+	Metainfo(torrent torrentInfo) (io.ReadCloser, error)
+}
+
+func (c *Config) TorrentClient(log logging.Notepad, remote remoteHost, store *state.Store) (torrentClient, error) {
+	switch c.Remote.Client {
+	case clientQbittorrent:
+		return newQbittorrentClient(log, &c.Remote.Qbittorrent, remote, store)
+	case clientTransmission:
+		return newTransmissionClient(log, &c.Remote.Transmission, remote, store), nil
+	case clientDeluge:
+		return newDelugeClient(log, &c.Remote.Deluge, remote, store)
+	case clientDirectory:
+		return newDirectoryClient(log, &c.Remote.Directory, remote, store), nil
+	case clientRtorrent:
+		return newRtorrentClient(c, log, remote, store)
+	default:
+		return nil, fmt.Errorf("unknown torrent client %q", c.Remote.Client)
+	}
+}
+
+// tunnelTransport makes HTTP connections from the remote host, through the
+// shared ssh connection unless the remote host is local.
+func tunnelTransport(log logging.Notepad, remote remoteHost) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			log.TRACE.Printf("Connecting to %s", addr)
+			return remote.Dial(network, addr)
+		},
+		MaxIdleConns:    4,
+		IdleConnTimeout: time.Minute,
+	}
+}
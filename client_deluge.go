@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/state"
+	"github.com/pkg/errors"
+)
+
+// the Web UI's error code for a request without a valid session
+const kDelugeNotAuthenticated = 1
+
+var _ torrentClient = (*delugeClient)(nil)
+
+// delugeClient talks to the Deluge Web UI JSON-RPC API over ssh.
+type delugeClient struct {
+	syncMarker
+
+	log    logging.Notepad
+	cfg    *DelugeConfig
+	http   *http.Client
+	remote remoteHost
+	nextID atomic.Uint64
+
+	loginMu  sync.Mutex
+	loggedIn bool
+}
+
+type delugeError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e *delugeError) Error() string {
+	return e.Message
+}
+
+type delugeTorrent struct {
+	Name          string  `json:"name"`
+	SavePath      string  `json:"save_path"`
+	Label         string  `json:"label"`
+	TotalWanted   int64   `json:"total_wanted"`
+	IsFinished    bool    `json:"is_finished"`
+	CompletedTime float64 `json:"completed_time"`
+	Files         []struct {
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+	FilePriorities []int `json:"file_priorities"`
+	Trackers       []struct {
+		URL string `json:"url"`
+	} `json:"trackers"`
+}
+
+var delugeListKeys = []string{"name", "save_path", "label", "total_wanted", "is_finished", "completed_time"}
+
+func newDelugeClient(log logging.Notepad, cfg *DelugeConfig, remote remoteHost, store *state.Store) (*delugeClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &delugeClient{
+		log: log,
+		cfg: cfg,
+		http: &http.Client{
+			Transport: tunnelTransport(log, remote),
+			Jar:       jar,
+			Timeout:   time.Minute,
+		},
+		remote: remote,
+	}
+
+	switch cfg.SyncMarker {
+	case markerLabel:
+		client.syncMarker = delugeLabelMarker{client}
+	default:
+		client.syncMarker = stateMarker{store}
+	}
+
+	return client, nil
+}
+
+func (c *delugeClient) rawCall(method string, params []any, result any) error {
+	if params == nil {
+		params = []any{}
+	}
+	body, err := json.Marshal(map[string]any{
+		"method": method,
+		"params": params,
+		"id":     c.nextID.Add(1),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "deluge: %s: encode error", method)
+	}
+
+	resp, err := c.http.Post(c.cfg.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "deluge: %s failed", method)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("deluge: %s failed: %s", method, resp.Status)
+	}
+
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *delugeError    `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return errors.Wrapf(err, "deluge: %s returned invalid json", method)
+	}
+	if reply.Error != nil {
+		return errors.Wrapf(reply.Error, "deluge: %s failed", method)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return errors.Wrapf(json.Unmarshal(reply.Result, result), "deluge: %s returned an invalid result", method)
+}
+
+// login authenticates and connects the Web UI to a daemon if needed.
+func (c *delugeClient) login() error {
+	var ok bool
+	if err := c.rawCall("auth.login", []any{c.cfg.Password}, &ok); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("deluge: login failed: bad password")
+	}
+
+	var connected bool
+	if err := c.rawCall("web.connected", nil, &connected); err != nil {
+		return err
+	}
+
+	if !connected {
+		var hosts [][]any
+		if err := c.rawCall("web.get_hosts", nil, &hosts); err != nil {
+			return err
+		}
+		if len(hosts) == 0 || len(hosts[0]) == 0 {
+			return errors.New("deluge: the web ui has no daemon to connect to")
+		}
+
+		c.log.DEBUG.Printf("connecting the deluge web ui to daemon %v", hosts[0][0])
+		if err := c.rawCall("web.connect", []any{hosts[0][0]}, nil); err != nil {
+			return err
+		}
+	}
+
+	c.loggedIn = true
+	return nil
+}
+
+// call makes a request, logging in again if the session has expired.
+func (c *delugeClient) call(method string, params []any, result any) error {
+	for attempt := 0; ; attempt++ {
+		c.loginMu.Lock()
+		if !c.loggedIn {
+			if err := c.login(); err != nil {
+				c.loginMu.Unlock()
+				return err
+			}
+		}
+		c.loginMu.Unlock()
+
+		err := c.rawCall(method, params, result)
+		var rpcErr *delugeError
+		if attempt == 0 && errors.As(err, &rpcErr) && rpcErr.Code == kDelugeNotAuthenticated {
+			c.log.DEBUG.Println("deluge session expired, logging in again")
+			c.loginMu.Lock()
+			c.loggedIn = false
+			c.loginMu.Unlock()
+			continue
+		}
+		return err
+	}
+}
+
+func (c *delugeClient) status(hash string, keys []string) (*delugeTorrent, error) {
+	var t delugeTorrent
+	if err := c.call("core.get_torrent_status", []any{hash, keys}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (c *delugeClient) Torrents() ([]torrentInfo, error) {
+	var torrents map[string]delugeTorrent
+	if err := c.call("core.get_torrents_status", []any{map[string]any{}, delugeListKeys}, &torrents); err != nil {
+		return nil, err
+	}
+
+	infos := make([]torrentInfo, 0, len(torrents))
+	for hash, t := range torrents {
+		info := torrentInfo{
+			Hash:      hash,
+			Name:      t.Name,
+			Path:      t.SavePath,
+			Label:     t.Label,
+			Size:      t.TotalWanted,
+			Completed: t.IsFinished,
+		}
+		if t.CompletedTime > 0 {
+			info.Finished = time.Unix(int64(t.CompletedTime), 0)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Files lists the torrent's wanted files relative to its root folder.
+func (c *delugeClient) Files(torrent *torrentInfo) ([]torrentFile, error) {
+	t, err := c.status(torrent.Hash, []string{"name", "save_path", "files", "file_priorities"})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []torrentFile
+	for idx, f := range t.Files {
+		rel, inRoot := strings.CutPrefix(f.Path, t.Name+"/")
+		if inRoot {
+			torrent.MultiFile = true
+		}
+		if idx < len(t.FilePriorities) && t.FilePriorities[idx] == 0 {
+			continue
+		}
+		result = append(result, torrentFile{
+			Path:   rel,
+			Size:   f.Size,
+			Remote: path.Join(t.SavePath, f.Path),
+		})
+	}
+	return result, nil
+}
+
+func (c *delugeClient) Trackers(torrent torrentInfo) ([]string, error) {
+	t, err := c.status(torrent.Hash, []string{"trackers"})
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, tracker := range t.Trackers {
+		urls = append(urls, tracker.URL)
+	}
+	return urls, nil
+}
+
+// Metainfo reads the .torrent file from the daemon's state directory.
+func (c *delugeClient) Metainfo(torrent torrentInfo) (io.ReadCloser, error) {
+	fs, err := c.remote.FS()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Open(path.Join(c.cfg.StateDir, torrent.Hash+".torrent"))
+}
+
+// delugeLabelMarker replaces the torrent's label with the sync tag.
+type delugeLabelMarker struct {
+	client *delugeClient
+}
+
+func (m delugeLabelMarker) IsSynced(torrent torrentInfo) (bool, error) {
+	return torrent.Label == m.client.cfg.SyncTag, nil
+}
+
+func (m delugeLabelMarker) MarkSynced(torrent torrentInfo) error {
+	var labels []string
+	if err := m.client.call("label.get_labels", nil, &labels); err != nil {
+		return err
+	}
+
+	exists := false
+	for _, label := range labels {
+		if label == m.client.cfg.SyncTag {
+			exists = true
+			break
+		}
+	}
+	if !exists {
+		if err := m.client.call("label.add", []any{m.client.cfg.SyncTag}, nil); err != nil {
+			return err
+		}
+	}
+
+	return m.client.call("label.set_torrent", []any{torrent.Hash, m.client.cfg.SyncTag}, nil)
+}
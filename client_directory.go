@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/state"
+	"github.com/pkg/errors"
+)
+
+// entries are keyed in the state database by this prefix and their name
+const kDirectoryKeyPrefix = "dir:"
+
+var _ torrentClient = (*directoryClient)(nil)
+
+// directoryClient syncs each top-level entry of a remote directory.
+type directoryClient struct {
+	syncMarker
+
+	log    logging.Notepad
+	cfg    *DirectoryConfig
+	remote remoteHost
+
+	// files found by the last listing, keyed by entry
+	mu    sync.Mutex
+	files map[string][]torrentFile
+}
+
+func newDirectoryClient(log logging.Notepad, cfg *DirectoryConfig, remote remoteHost, store *state.Store) *directoryClient {
+	return &directoryClient{
+		syncMarker: directoryMarker{store},
+		log:        log,
+		cfg:        cfg,
+		remote:     remote,
+		files:      make(map[string][]torrentFile),
+	}
+}
+
+// Torrents lists every top-level entry as a completed torrent.
+func (c *directoryClient) Torrents() ([]torrentInfo, error) {
+	fs, err := c.remote.FS()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(c.cfg.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", c.cfg.Path)
+	}
+
+	var infos []torrentInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !c.cfg.IncludeHidden {
+			continue
+		}
+		if !entry.IsDir() && !entry.Mode().IsRegular() {
+			c.log.DEBUG.Printf("skipping %s: not a file or directory", name)
+			continue
+		}
+
+		info := torrentInfo{
+			Hash:      kDirectoryKeyPrefix + name,
+			Name:      name,
+			Path:      c.cfg.Path,
+			Completed: true,
+			MultiFile: entry.IsDir(),
+		}
+
+		files, newest, err := c.walk(info)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			info.Size += f.Size
+		}
+		info.Finished = newest
+
+		c.mu.Lock()
+		c.files[info.Hash] = files
+		c.mu.Unlock()
+
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// walk lists the regular files of an entry and their newest modification time.
+func (c *directoryClient) walk(info torrentInfo) ([]torrentFile, time.Time, error) {
+	var newest time.Time
+	fs, err := c.remote.FS()
+	if err != nil {
+		return nil, newest, err
+	}
+
+	root := path.Join(info.Path, info.Name)
+	var files []torrentFile
+	err = fs.Walk(root, func(remote string, stat os.FileInfo) error {
+		if !stat.Mode().IsRegular() {
+			return nil
+		}
+		if stat.ModTime().After(newest) {
+			newest = stat.ModTime()
+		}
+
+		rel := stat.Name()
+		if info.MultiFile {
+			rel = strings.TrimPrefix(remote, root+"/")
+		}
+		files = append(files, torrentFile{
+			Path:   rel,
+			Size:   stat.Size(),
+			Remote: remote,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, newest, err
+	}
+	return files, newest, nil
+}
+
+func (c *directoryClient) Files(torrent *torrentInfo) ([]torrentFile, error) {
+	c.mu.Lock()
+	files, ok := c.files[torrent.Hash]
+	c.mu.Unlock()
+	if ok {
+		return files, nil
+	}
+
+	files, _, err := c.walk(*torrent)
+	return files, err
+}
+
+func (c *directoryClient) Trackers(torrent torrentInfo) ([]string, error) {
+	return nil, nil
+}
+
+func (c *directoryClient) Metainfo(torrent torrentInfo) (io.ReadCloser, error) {
+	return nil, errors.New("mirrored directories have no metainfo")
+}
+
+// directoryMarker records synced entries with their size and modification time.
+type directoryMarker struct {
+	store *state.Store
+}
+
+func (m directoryMarker) IsSynced(torrent torrentInfo) (bool, error) {
+	record, err := m.store.Torrent(torrent.Hash)
+	if err != nil || record == nil {
+		return false, err
+	}
+	return record.Size == torrent.Size && !torrent.Finished.After(record.ModTime), nil
+}
+
+func (m directoryMarker) MarkSynced(torrent torrentInfo) error {
+	return m.store.PutTorrent(torrent.Hash, state.Torrent{
+		Name:     torrent.Name,
+		SyncedAt: time.Now(),
+		Size:     torrent.Size,
+		ModTime:  torrent.Finished,
+	})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/state"
+	"github.com/pkg/errors"
+)
+
+var _ torrentClient = (*qbittorrentClient)(nil)
+
+// qbittorrentClient talks to the qBittorrent Web API v2 over ssh.
+type qbittorrentClient struct {
+	syncMarker
+
+	log      logging.Notepad
+	cfg      *QbittorrentConfig
+	base     *url.URL
+	http     *http.Client
+	loginMu  sync.Mutex
+	loggedIn bool
+
+	// content paths and tags from the last listing
+	mu          sync.Mutex
+	contentPath map[string]string
+	tags        map[string]string
+}
+
+type qbittorrentTorrent struct {
+	Hash         string  `json:"hash"`
+	Name         string  `json:"name"`
+	SavePath     string  `json:"save_path"`
+	ContentPath  string  `json:"content_path"`
+	Category     string  `json:"category"`
+	Tags         string  `json:"tags"`
+	Size         int64   `json:"size"`
+	Progress     float64 `json:"progress"`
+	AmountLeft   int64   `json:"amount_left"`
+	CompletionOn int64   `json:"completion_on"`
+}
+
+type qbittorrentFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Priority int    `json:"priority"`
+}
+
+type qbittorrentTracker struct {
+	URL string `json:"url"`
+}
+
+func newQbittorrentClient(log logging.Notepad, cfg *QbittorrentConfig, remote remoteHost, store *state.Store) (*qbittorrentClient, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "qbittorrent: invalid url")
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &qbittorrentClient{
+		log:  log,
+		cfg:  cfg,
+		base: base,
+		http: &http.Client{
+			Transport: tunnelTransport(log, remote),
+			Jar:       jar,
+			Timeout:   time.Minute,
+		},
+		contentPath: make(map[string]string),
+		tags:        make(map[string]string),
+	}
+
+	switch cfg.SyncMarker {
+	case markerState:
+		client.syncMarker = stateMarker{store}
+	case markerCategory:
+		client.syncMarker = qbittorrentCategoryMarker{client}
+	default:
+		client.syncMarker = qbittorrentTagMarker{client}
+	}
+
+	return client, nil
+}
+
+func (c *qbittorrentClient) endpoint(method string) string {
+	u := *c.base
+	u.Path = path.Join(u.Path, "api/v2", method)
+	return u.String()
+}
+
+func (c *qbittorrentClient) login() error {
+	form := url.Values{
+		"username": {c.cfg.Username},
+		"password": {c.cfg.Password},
+	}
+	resp, err := c.http.PostForm(c.endpoint("auth/login"), form)
+	if err != nil {
+		return errors.Wrap(err, "qbittorrent: login failed")
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("qbittorrent: login failed: %s", resp.Status)
+	}
+	if strings.TrimSpace(string(body)) != "Ok." {
+		return errors.New("qbittorrent: login failed: bad username or password")
+	}
+
+	c.loggedIn = true
+	return nil
+}
+
+// do sends a request, logging in again if the session has expired.
+func (c *qbittorrentClient) do(method string, params url.Values) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		c.loginMu.Lock()
+		if !c.loggedIn {
+			if err := c.login(); err != nil {
+				c.loginMu.Unlock()
+				return nil, err
+			}
+		}
+		c.loginMu.Unlock()
+
+		resp, err := c.http.PostForm(c.endpoint(method), params)
+		if err != nil {
+			return nil, errors.Wrapf(err, "qbittorrent: %s failed", method)
+		}
+
+		if resp.StatusCode == http.StatusForbidden && attempt == 0 {
+			resp.Body.Close()
+			c.log.DEBUG.Println("qbittorrent session expired, logging in again")
+			c.loginMu.Lock()
+			c.loggedIn = false
+			c.loginMu.Unlock()
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("qbittorrent: %s failed: %s", method, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+func (c *qbittorrentClient) call(method string, params url.Values, result any) error {
+	resp, err := c.do(method, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return errors.Wrapf(err, "qbittorrent: %s returned invalid json", method)
+	}
+	return nil
+}
+
+func (c *qbittorrentClient) info(params url.Values) ([]qbittorrentTorrent, error) {
+	var torrents []qbittorrentTorrent
+	if err := c.call("torrents/info", params, &torrents); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	for _, t := range torrents {
+		c.contentPath[t.Hash] = t.ContentPath
+		c.tags[t.Hash] = t.Tags
+	}
+	c.mu.Unlock()
+
+	return torrents, nil
+}
+
+func (c *qbittorrentClient) Torrents() ([]torrentInfo, error) {
+	torrents, err := c.info(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]torrentInfo, len(torrents))
+	for idx, t := range torrents {
+		infos[idx] = torrentInfo{
+			Hash:      t.Hash,
+			Name:      t.Name,
+			Path:      t.SavePath,
+			Label:     t.Category,
+			Size:      t.Size,
+			Completed: t.AmountLeft == 0 && t.Progress >= 1,
+		}
+		if t.CompletionOn > 0 {
+			infos[idx].Finished = time.Unix(t.CompletionOn, 0)
+		}
+	}
+	return infos, nil
+}
+
+// Files lists the torrent's wanted files relative to its content path.
+func (c *qbittorrentClient) Files(torrent *torrentInfo) ([]torrentFile, error) {
+	params := url.Values{"hash": {torrent.Hash}}
+
+	c.mu.Lock()
+	contentPath, ok := c.contentPath[torrent.Hash]
+	c.mu.Unlock()
+	if !ok {
+		if _, err := c.info(url.Values{"hashes": {torrent.Hash}}); err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		contentPath = c.contentPath[torrent.Hash]
+		c.mu.Unlock()
+	}
+
+	var files []qbittorrentFile
+	if err := c.call("torrents/files", params, &files); err != nil {
+		return nil, err
+	}
+
+	var result []torrentFile
+	for _, f := range files {
+		if strings.Contains(f.Name, "/") {
+			torrent.MultiFile = true
+		}
+		if f.Priority == 0 {
+			// not downloaded
+			continue
+		}
+
+		remote := path.Join(torrent.Path, f.Name)
+		rel := f.Name
+		if contentPath != "" && strings.HasPrefix(remote, contentPath+"/") {
+			rel = strings.TrimPrefix(remote, contentPath+"/")
+		}
+
+		result = append(result, torrentFile{
+			Path:   rel,
+			Size:   f.Size,
+			Remote: remote,
+		})
+	}
+	return result, nil
+}
+
+func (c *qbittorrentClient) Trackers(torrent torrentInfo) ([]string, error) {
+	var trackers []qbittorrentTracker
+	if err := c.call("torrents/trackers", url.Values{"hash": {torrent.Hash}}, &trackers); err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, t := range trackers {
+		// DHT, PeX and LSD are listed as "** [DHT] **" and so on
+		if strings.HasPrefix(t.URL, "**") {
+			continue
+		}
+		urls = append(urls, t.URL)
+	}
+	return urls, nil
+}
+
+// Metainfo exports the .torrent file, which needs qBittorrent 4.5 or newer.
+func (c *qbittorrentClient) Metainfo(torrent torrentInfo) (io.ReadCloser, error) {
+	resp, err := c.do("torrents/export", url.Values{"hash": {torrent.Hash}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *qbittorrentClient) hasTag(torrent torrentInfo, tag string) (bool, error) {
+	c.mu.Lock()
+	tags, ok := c.tags[torrent.Hash]
+	c.mu.Unlock()
+	if !ok {
+		torrents, err := c.info(url.Values{"hashes": {torrent.Hash}})
+		if err != nil {
+			return false, err
+		}
+		if len(torrents) == 0 {
+			return false, errors.Errorf("qbittorrent: torrent %s not found", torrent.Hash)
+		}
+		tags = torrents[0].Tags
+	}
+
+	for _, t := range strings.Split(tags, ",") {
+		if strings.TrimSpace(t) == tag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// qbittorrentTagMarker adds the sync tag, leaving the category alone.
+type qbittorrentTagMarker struct {
+	client *qbittorrentClient
+}
+
+func (m qbittorrentTagMarker) IsSynced(torrent torrentInfo) (bool, error) {
+	return m.client.hasTag(torrent, m.client.cfg.SyncTag)
+}
+
+func (m qbittorrentTagMarker) MarkSynced(torrent torrentInfo) error {
+	return m.client.call("torrents/addTags", url.Values{
+		"hashes": {torrent.Hash},
+		"tags":   {m.client.cfg.SyncTag},
+	}, nil)
+}
+
+// qbittorrentCategoryMarker moves synced torrents into the sync category.
+type qbittorrentCategoryMarker struct {
+	client *qbittorrentClient
+}
+
+func (m qbittorrentCategoryMarker) IsSynced(torrent torrentInfo) (bool, error) {
+	return torrent.Label == m.client.cfg.SyncTag, nil
+}
+
+func (m qbittorrentCategoryMarker) MarkSynced(torrent torrentInfo) error {
+	// creating a category that already exists fails with 409, which is fine
+	if resp, err := m.client.do("torrents/createCategory", url.Values{"category": {m.client.cfg.SyncTag}}); err == nil {
+		resp.Body.Close()
+	}
+
+	return m.client.call("torrents/setCategory", url.Values{
+		"hashes":   {torrent.Hash},
+		"category": {m.client.cfg.SyncTag},
+	}, nil)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io"
+	"path"
+	"sync"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/rtorrent"
+	"github.com/demosdemon/seedbox-sync/lib/state"
+	"github.com/pkg/errors"
+)
+
+// torrents per system.multicall when fetching files
+const kRtorrentBatchSize = 100
+
+var _ torrentClient = (*rtorrentClient)(nil)
+
+// rtorrentClient caches the torrent listing and fetches files in batches.
+type rtorrentClient struct {
+	syncMarker
+
+	log    logging.Notepad
+	rt     *rtorrent.Client
+	remote remoteHost
+	// the custom field read along with the torrents, if any
+	customField string
+
+	mu sync.Mutex
+	// hashes whose files will be wanted, in listing order
+	unsynced     []string
+	customs      map[string]string
+	sessionFiles map[string]string
+	files        map[string][]rtorrent.File
+	trackers     map[string][]string
+}
+
+func newRtorrentClient(c *Config, log logging.Notepad, remote remoteHost, store *state.Store) (*rtorrentClient, error) {
+	rt, err := c.RtorrentClient(log, remote)
+	if err != nil {
+		return nil, err
+	}
+	client := &rtorrentClient{
+		log:    log,
+		rt:     rt,
+		remote: remote,
+	}
+	if c.Remote.Rtorrent.SyncMarker == markerCustom {
+		client.customField = c.Remote.Rtorrent.SyncField
+	}
+	client.syncMarker = c.SyncMarker(client, store)
+	return client, nil
+}
+
+func (c *rtorrentClient) Torrents() ([]torrentInfo, error) {
+	var custom []string
+	if c.customField != "" {
+		custom = append(custom, c.customField)
+	}
+	torrents, err := c.rt.Torrents(rtorrent.ViewMain, custom...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.customs = make(map[string]string, len(torrents))
+	c.sessionFiles = make(map[string]string, len(torrents))
+	c.files = make(map[string][]rtorrent.File)
+	c.trackers = make(map[string][]string, len(torrents))
+	for _, t := range torrents {
+		c.sessionFiles[t.Hash] = t.SessionFile
+		c.trackers[t.Hash] = t.Trackers
+		if c.customField != "" {
+			c.customs[t.Hash] = t.Custom[c.customField]
+		}
+	}
+	c.mu.Unlock()
+
+	infos := make([]torrentInfo, len(torrents))
+	var unsynced []string
+	for idx, t := range torrents {
+		infos[idx] = torrentInfo{
+			Hash:      t.Hash,
+			Name:      t.Name,
+			Path:      t.Directory,
+			Label:     t.Label,
+			Size:      t.Size,
+			Completed: t.Complete,
+			Finished:  t.Finished,
+			MultiFile: t.MultiFile,
+		}
+		if !t.Complete {
+			continue
+		}
+		// the marker only reads the values fetched above or the local
+		// state database
+		if synced, err := c.IsSynced(infos[idx]); err == nil && !synced {
+			unsynced = append(unsynced, t.Hash)
+		}
+	}
+
+	c.mu.Lock()
+	c.unsynced = unsynced
+	c.mu.Unlock()
+
+	c.log.DEBUG.Printf("listed %d torrent(s), %d to sync", len(infos), len(unsynced))
+	return infos, nil
+}
+
+// custom returns the custom sync field of a torrent, preferring the listing.
+func (c *rtorrentClient) custom(hash string) (string, error) {
+	c.mu.Lock()
+	value, ok := c.customs[hash]
+	c.mu.Unlock()
+	if ok {
+		return value, nil
+	}
+	return c.rt.Custom(hash, c.customField)
+}
+
+func (c *rtorrentClient) Files(torrent *torrentInfo) ([]torrentFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files, ok := c.files[torrent.Hash]
+	if !ok {
+		hashes := nextBatch(torrent.Hash, c.unsynced, c.files)
+		c.log.DEBUG.Printf("fetching files of %d torrent(s)", len(hashes))
+		fetched, err := c.rt.Files(hashes...)
+		if err != nil {
+			return nil, err
+		}
+		for hash, list := range fetched {
+			c.files[hash] = list
+		}
+		if files, ok = fetched[torrent.Hash]; !ok {
+			return nil, errors.Errorf("rtorrent no longer has torrent %s", torrent.Hash)
+		}
+	}
+
+	result := make([]torrentFile, len(files))
+	for idx, f := range files {
+		result[idx] = torrentFile{
+			Path:   f.Path,
+			Size:   f.Size,
+			Remote: path.Join(torrent.Path, f.Path),
+		}
+	}
+	return result, nil
+}
+
+func (c *rtorrentClient) Trackers(torrent torrentInfo) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if urls, ok := c.trackers[torrent.Hash]; ok {
+		return urls, nil
+	}
+
+	fetched, err := c.rt.Trackers(torrent.Hash)
+	if err != nil {
+		return nil, err
+	}
+	urls, ok := fetched[torrent.Hash]
+	if !ok {
+		return nil, errors.Errorf("rtorrent no longer has torrent %s", torrent.Hash)
+	}
+	return urls, nil
+}
+
+// nextBatch returns hash and up to a batch of unfetched candidates after it.
+func nextBatch[T any](hash string, candidates []string, fetched map[string]T) []string {
+	batch := []string{hash}
+	start := len(candidates)
+	for idx, candidate := range candidates {
+		if candidate == hash {
+			start = idx + 1
+			break
+		}
+	}
+	for _, candidate := range candidates[start:] {
+		if len(batch) >= kRtorrentBatchSize {
+			break
+		}
+		if _, ok := fetched[candidate]; !ok {
+			batch = append(batch, candidate)
+		}
+	}
+	return batch
+}
+
+// Metainfo reads the .torrent file from rtorrent's session directory.
+func (c *rtorrentClient) Metainfo(torrent torrentInfo) (io.ReadCloser, error) {
+	c.mu.Lock()
+	sessionFile, ok := c.sessionFiles[torrent.Hash]
+	c.mu.Unlock()
+	if !ok {
+		var err error
+		if sessionFile, err = c.rt.String("d.session_file", torrent.Hash); err != nil {
+			return nil, err
+		}
+	}
+	if sessionFile == "" {
+		return nil, errors.New("rtorrent has no session file for this torrent")
+	}
+
+	fs, err := c.remote.FS()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Open(sessionFile)
+}
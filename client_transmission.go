@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/state"
+	"github.com/pkg/errors"
+)
+
+const transmissionSessionHeader = "X-Transmission-Session-Id"
+
+var _ torrentClient = (*transmissionClient)(nil)
+
+// transmissionClient talks to Transmission's JSON-RPC endpoint over ssh.
+type transmissionClient struct {
+	syncMarker
+
+	log    logging.Notepad
+	cfg    *TransmissionConfig
+	http   *http.Client
+	remote remoteHost
+
+	mu        sync.Mutex
+	sessionID string
+	// labels from the last listing and details fetched since
+	labels  map[string][]string
+	details map[string]*transmissionTorrent
+}
+
+type transmissionTorrent struct {
+	HashString    string   `json:"hashString"`
+	Name          string   `json:"name"`
+	DownloadDir   string   `json:"downloadDir"`
+	Labels        []string `json:"labels"`
+	SizeWhenDone  int64    `json:"sizeWhenDone"`
+	LeftUntilDone int64    `json:"leftUntilDone"`
+	PercentDone   float64  `json:"percentDone"`
+	DoneDate      int64    `json:"doneDate"`
+	TorrentFile   string   `json:"torrentFile"`
+	Files         []struct {
+		Name   string `json:"name"`
+		Length int64  `json:"length"`
+	} `json:"files"`
+	Wanted   []bool `json:"wanted"`
+	Trackers []struct {
+		Announce string `json:"announce"`
+	} `json:"trackers"`
+}
+
+var transmissionListFields = []string{
+	"hashString", "name", "downloadDir", "labels", "sizeWhenDone",
+	"leftUntilDone", "percentDone", "doneDate",
+}
+
+var transmissionDetailFields = []string{
+	"name", "downloadDir", "labels", "files", "wanted", "trackers", "torrentFile",
+}
+
+func newTransmissionClient(log logging.Notepad, cfg *TransmissionConfig, remote remoteHost, store *state.Store) *transmissionClient {
+	client := &transmissionClient{
+		log: log,
+		cfg: cfg,
+		http: &http.Client{
+			Transport: tunnelTransport(log, remote),
+			Timeout:   time.Minute,
+		},
+		remote:  remote,
+		labels:  make(map[string][]string),
+		details: make(map[string]*transmissionTorrent),
+	}
+
+	switch cfg.SyncMarker {
+	case markerState:
+		client.syncMarker = stateMarker{store}
+	default:
+		client.syncMarker = transmissionLabelMarker{client}
+	}
+
+	return client
+}
+
+// call makes an RPC request, fetching a new session id on 409 Conflict.
+func (c *transmissionClient) call(method string, args any, result any) error {
+	body, err := json.Marshal(map[string]any{
+		"method":    method,
+		"arguments": args,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "transmission: %s: encode error", method)
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrapf(err, "transmission: %s", method)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.cfg.Username != "" {
+			req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+		}
+
+		c.mu.Lock()
+		if c.sessionID != "" {
+			req.Header.Set(transmissionSessionHeader, c.sessionID)
+		}
+		c.mu.Unlock()
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return errors.Wrapf(err, "transmission: %s failed", method)
+		}
+
+		if resp.StatusCode == http.StatusConflict && attempt == 0 {
+			resp.Body.Close()
+			c.mu.Lock()
+			c.sessionID = resp.Header.Get(transmissionSessionHeader)
+			c.mu.Unlock()
+			c.log.TRACE.Println("transmission session id updated")
+			continue
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("transmission: %s failed: %s", method, resp.Status)
+		}
+
+		var reply struct {
+			Result    string          `json:"result"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			return errors.Wrapf(err, "transmission: %s returned invalid json", method)
+		}
+		if reply.Result != "success" {
+			return errors.Errorf("transmission: %s failed: %s", method, reply.Result)
+		}
+
+		if result == nil || len(reply.Arguments) == 0 {
+			return nil
+		}
+		return errors.Wrapf(json.Unmarshal(reply.Arguments, result), "transmission: %s returned invalid arguments", method)
+	}
+}
+
+func (c *transmissionClient) get(hash string, fields []string) ([]transmissionTorrent, error) {
+	args := map[string]any{"fields": fields}
+	if hash != "" {
+		args["ids"] = []string{hash}
+	}
+
+	var result struct {
+		Torrents []transmissionTorrent `json:"torrents"`
+	}
+	if err := c.call("torrent-get", args, &result); err != nil {
+		return nil, err
+	}
+	if hash != "" && len(result.Torrents) == 0 {
+		return nil, errors.Errorf("transmission: torrent %s not found", hash)
+	}
+	return result.Torrents, nil
+}
+
+// detail returns a torrent's files, trackers and torrent file, once per listing.
+func (c *transmissionClient) detail(hash string) (*transmissionTorrent, error) {
+	c.mu.Lock()
+	t, ok := c.details[hash]
+	c.mu.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	torrents, err := c.get(hash, transmissionDetailFields)
+	if err != nil {
+		return nil, err
+	}
+	t = &torrents[0]
+
+	c.mu.Lock()
+	c.details[hash] = t
+	c.mu.Unlock()
+	return t, nil
+}
+
+func (c *transmissionClient) Torrents() ([]torrentInfo, error) {
+	torrents, err := c.get("", transmissionListFields)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.labels = make(map[string][]string, len(torrents))
+	c.details = make(map[string]*transmissionTorrent)
+	for _, t := range torrents {
+		c.labels[t.HashString] = t.Labels
+	}
+	c.mu.Unlock()
+
+	infos := make([]torrentInfo, len(torrents))
+	for idx, t := range torrents {
+		infos[idx] = torrentInfo{
+			Hash:      t.HashString,
+			Name:      t.Name,
+			Path:      t.DownloadDir,
+			Size:      t.SizeWhenDone,
+			Completed: t.LeftUntilDone == 0 && t.PercentDone >= 1,
+		}
+		if len(t.Labels) > 0 {
+			infos[idx].Label = t.Labels[0]
+		}
+		if t.DoneDate > 0 {
+			infos[idx].Finished = time.Unix(t.DoneDate, 0)
+		}
+	}
+	return infos, nil
+}
+
+// Files lists the torrent's wanted files relative to its root folder.
+func (c *transmissionClient) Files(torrent *torrentInfo) ([]torrentFile, error) {
+	t, err := c.detail(torrent.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []torrentFile
+	for idx, f := range t.Files {
+		rel, inRoot := strings.CutPrefix(f.Name, t.Name+"/")
+		if inRoot {
+			torrent.MultiFile = true
+		}
+		if idx < len(t.Wanted) && !t.Wanted[idx] {
+			continue
+		}
+		result = append(result, torrentFile{
+			Path:   rel,
+			Size:   f.Length,
+			Remote: path.Join(t.DownloadDir, f.Name),
+		})
+	}
+	return result, nil
+}
+
+func (c *transmissionClient) Trackers(torrent torrentInfo) ([]string, error) {
+	t, err := c.detail(torrent.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, tracker := range t.Trackers {
+		urls = append(urls, tracker.Announce)
+	}
+	return urls, nil
+}
+
+// Metainfo reads the .torrent file from Transmission's config directory.
+func (c *transmissionClient) Metainfo(torrent torrentInfo) (io.ReadCloser, error) {
+	t, err := c.detail(torrent.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if t.TorrentFile == "" {
+		return nil, errors.New("transmission has no torrent file for this torrent")
+	}
+
+	fs, err := c.remote.FS()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Open(t.TorrentFile)
+}
+
+// transmissionLabelMarker adds the sync tag to a torrent's labels.
+type transmissionLabelMarker struct {
+	client *transmissionClient
+}
+
+func (m transmissionLabelMarker) labels(torrent torrentInfo) ([]string, error) {
+	m.client.mu.Lock()
+	labels, ok := m.client.labels[torrent.Hash]
+	m.client.mu.Unlock()
+	if ok {
+		return labels, nil
+	}
+
+	t, err := m.client.detail(torrent.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return t.Labels, nil
+}
+
+func (m transmissionLabelMarker) IsSynced(torrent torrentInfo) (bool, error) {
+	labels, err := m.labels(torrent)
+	if err != nil {
+		return false, err
+	}
+	for _, label := range labels {
+		if label == m.client.cfg.SyncTag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m transmissionLabelMarker) MarkSynced(torrent torrentInfo) error {
+	labels, err := m.labels(torrent)
+	if err != nil {
+		return err
+	}
+
+	labels = append(append([]string(nil), labels...), m.client.cfg.SyncTag)
+	if err := m.client.call("torrent-set", map[string]any{
+		"ids":    []string{torrent.Hash},
+		"labels": labels,
+	}, nil); err != nil {
+		return err
+	}
+
+	m.client.mu.Lock()
+	m.client.labels[torrent.Hash] = labels
+	m.client.mu.Unlock()
+	return nil
+}
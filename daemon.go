@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+)
+
+// runDaemon polls rtorrent on the configured interval and syncs torrents
+// that have completed since they were last seen. The shared unit, its ssh
+// connection and the work queues stay alive between polls.
+func runDaemon(shared *sharedUnit) {
+	interval := shared.config.Daemon.Interval
+	shared.log.INFO.Printf("Running as a daemon, polling every %s", interval)
+
+	synced := make(map[string]bool)
+	// torrents in the last listing, so removed torrents can be forgotten
+	listed := make(map[string]bool)
+	filter := func(torrent torrentInfo) bool {
+		listed[torrent.Hash] = true
+		return torrent.Completed && !synced[torrent.Hash]
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if hashes, err := syncTorrents(shared, filter); err != nil {
+			shared.log.ERROR.Printf("Error getting torrents: %s", err)
+		} else {
+			for hash := range synced {
+				if !listed[hash] {
+					delete(synced, hash)
+				}
+			}
+			for _, hash := range hashes {
+				synced[hash] = true
+			}
+		}
+		listed = make(map[string]bool)
+
+		select {
+		case <-ticker.C:
+		case <-shared.stopCtx.Done():
+			shared.log.INFO.Println("Daemon stopped")
+			return
+		}
+	}
+}
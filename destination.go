@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const kDefaultFinishedLayout = "2006-01-02"
+
+// matches {key} and {key:argument}
+var placeholderPattern = regexp.MustCompile(`\{([a-z]+)(?::([^{}]*))?\}`)
+
+var placeholders = map[string]bool{
+	"label":    true,
+	"name":     true,
+	"tracker":  true,
+	"finished": true,
+}
+
+func validateDestination(tmpl string) error {
+	for _, match := range placeholderPattern.FindAllStringSubmatch(tmpl, -1) {
+		if !placeholders[match[1]] {
+			return fmt.Errorf("unknown placeholder %q in destination %q", match[0], tmpl)
+		}
+	}
+	return nil
+}
+
+// destinationTemplate picks the destination for a torrent: the destination of
+// the deciding selection rule, then one configured for its label, and finally
+// local.destination.
+func (c *Config) destinationTemplate(torrent torrentInfo, rule int) string {
+	if rule >= 0 && c.Rules[rule].Destination != "" {
+		return c.Rules[rule].Destination
+	}
+	if tmpl, ok := c.Local.Destinations[torrent.Label]; ok {
+		return tmpl
+	}
+	return c.Local.Destination
+}
+
+// expandDestination replaces the placeholders in a destination template.
+// Substituted values cannot introduce new path components or remove one; an
+// empty value, such as the label of an unlabeled torrent, becomes "_".
+func expandDestination(tmpl string, torrent torrentInfo, trackers func() ([]string, error)) (string, error) {
+	var err error
+	expanded := placeholderPattern.ReplaceAllStringFunc(tmpl, func(match string) string {
+		parts := placeholderPattern.FindStringSubmatch(match)
+		var value string
+		switch parts[1] {
+		case "label":
+			value = torrent.Label
+		case "name":
+			value = torrent.Name
+		case "tracker":
+			urls, trackerErr := trackers()
+			if err == nil {
+				err = trackerErr
+			}
+			value = firstTrackerHost(urls)
+		case "finished":
+			layout := parts[2]
+			if layout == "" {
+				layout = kDefaultFinishedLayout
+			}
+			value = torrent.Finished.Format(layout)
+		}
+		return sanitizePathComponent(value)
+	})
+	if err != nil {
+		return "", err
+	}
+	return path.Clean(expanded), nil
+}
+
+func firstTrackerHost(urls []string) string {
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+	return ""
+}
+
+func sanitizePathComponent(value string) string {
+	if value == "" {
+		return "_"
+	}
+	value = strings.ReplaceAll(value, "/", "_")
+	if value == "." || value == ".." {
+		value = strings.Repeat("_", len(value))
+	}
+	return value
+}
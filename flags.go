@@ -4,4 +4,5 @@ import "flag"
 
 var (
 	flagDryRun = flag.Bool("dry-run", false, "don't actually do anything")
+	flagDaemon = flag.Bool("daemon", false, "keep running and sync newly completed torrents")
 )
@@ -5,12 +5,16 @@ go 1.20
 require (
 	github.com/BurntSushi/toml v1.2.1
 	github.com/alessio/shellescape v1.4.1
+	github.com/kevinburke/ssh_config v1.2.0
 	github.com/mrobinsn/go-rtorrent v1.8.0
 	github.com/pkg/errors v0.9.1
 	github.com/pkg/sftp v1.13.5
 	github.com/spf13/jwalterweatherman v1.1.0
 	github.com/vbauerster/mpb/v8 v8.2.0
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.6.0
+	golang.org/x/net v0.6.0
+	golang.org/x/term v0.5.0
 )
 
 require (
@@ -19,6 +23,5 @@ require (
 	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
-	github.com/stretchr/testify v1.7.5 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 )
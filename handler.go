@@ -1,28 +1,58 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/demosdemon/seedbox-sync/lib/logging"
 )
 
+// errShuttingDown is passed to the callback of units that are refused or
+// dropped because a shutdown has begun.
+var errShuttingDown = errors.New("shutting down")
+
+// Handler is a unit of work. The context passed to Handle is cancelled when
+// Handle returns, when the queue's timeout passes or when in-flight work is
+// aborted, so it must not be retained by work that continues asynchronously.
 type Handler interface {
-	Handle()
+	Handle(context.Context)
 
 	Callback(error)
 }
 
+// queueContext carries the lifetimes shared by every work queue.
+type queueContext struct {
+	// stop is cancelled when no new work should be accepted
+	stop context.Context
+	// work is the parent of every unit's context; it is cancelled to abort
+	// in-flight work
+	work context.Context
+}
+
 type WorkQueue[T Handler] struct {
-	log logging.Notepad
-	wg  sync.WaitGroup
-	ch  chan<- T
+	log  logging.Notepad
+	wg   sync.WaitGroup
+	ch   chan<- T
+	stop <-chan struct{}
 }
 
 type worker[T Handler] struct {
-	log logging.Notepad
-	wg  *sync.WaitGroup
-	ch  <-chan T
+	log     logging.Notepad
+	wg      *sync.WaitGroup
+	ch      <-chan T
+	stop    <-chan struct{}
+	work    context.Context
+	timeout time.Duration
+}
+
+func (w worker[T]) context() (context.Context, context.CancelFunc) {
+	if w.timeout > 0 {
+		return context.WithTimeout(w.work, w.timeout)
+	}
+	return context.WithCancel(w.work)
 }
 
 func (w worker[T]) exec() {
@@ -50,16 +80,43 @@ func (w worker[T]) exec() {
 				}
 			}()
 
+			select {
+			case <-w.stop:
+				w.log.DEBUG.Printf("dropping %T during shutdown", unit)
+				unit.Callback(errShuttingDown)
+				return
+			default:
+			}
+
+			ctx, cancel := w.context()
+			defer cancel()
+
 			w.log.TRACE.Printf("handling %T", unit)
-			unit.Handle()
+			unit.Handle(ctx)
 		}()
 	}
 }
 
+// Send queues a unit for handling. Once the queue's stop channel is closed,
+// units are refused and their callback receives errShuttingDown.
 func (queue *WorkQueue[T]) Send(unit T) {
 	queue.log.TRACE.Printf("sending %T", unit)
-	queue.ch <- unit
-	queue.log.TRACE.Printf("sent %T", unit)
+
+	select {
+	case <-queue.stop:
+		queue.log.DEBUG.Printf("refusing %T during shutdown", unit)
+		unit.Callback(errShuttingDown)
+		return
+	default:
+	}
+
+	select {
+	case queue.ch <- unit:
+		queue.log.TRACE.Printf("sent %T", unit)
+	case <-queue.stop:
+		queue.log.DEBUG.Printf("refusing %T during shutdown", unit)
+		unit.Callback(errShuttingDown)
+	}
 }
 
 func (queue *WorkQueue[T]) Close() {
@@ -70,7 +127,9 @@ func (queue *WorkQueue[T]) Close() {
 	queue.log.DEBUG.Println("handler exited")
 }
 
-func NewQueue[T Handler](name string, newLog func(string) logging.Notepad, count, buffer int) *WorkQueue[T] {
+// NewQueue starts count workers for units of type T. A positive timeout is
+// the deadline for each unit's Handle.
+func NewQueue[T Handler](ctx queueContext, name string, newLog func(string) logging.Notepad, count, buffer int, timeout time.Duration) *WorkQueue[T] {
 	var ch chan T
 	if buffer > 0 {
 		ch = make(chan T, buffer)
@@ -79,16 +138,20 @@ func NewQueue[T Handler](name string, newLog func(string) logging.Notepad, count
 	}
 
 	queue := &WorkQueue[T]{
-		log: newLog(fmt.Sprintf("%s-queue", name)),
-		ch:  ch,
+		log:  newLog(fmt.Sprintf("%s-queue", name)),
+		ch:   ch,
+		stop: ctx.stop.Done(),
 	}
 
 	queue.wg.Add(count)
 	for idx := 0; idx < count; idx++ {
 		go worker[T]{
-			wg:  &queue.wg,
-			log: newLog(fmt.Sprintf("%s-worker-%d", name, idx)),
-			ch:  ch,
+			wg:      &queue.wg,
+			log:     newLog(fmt.Sprintf("%s-worker-%d", name, idx)),
+			ch:      ch,
+			stop:    ctx.stop.Done(),
+			work:    ctx.work,
+			timeout: timeout,
 		}.exec()
 	}
 
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/state"
 	"github.com/pkg/errors"
+	"github.com/vbauerster/mpb/v8"
 )
 
+// read buffer per download segment
+const kSegmentBuffer = 1 << 20
+
 var _ Handler = (*downloadUnit)(nil)
 
 type downloadUnit struct {
@@ -19,48 +28,184 @@ type downloadUnit struct {
 	local    fileMetadata
 	remote   fileMetadata
 	callback func(error)
+
+	// bytes fetched from the remote, set once the unit completes
+	transferred int64
+	// how the local file was checked, set once the unit completes
+	hash string
 }
 
 func (unit *downloadUnit) Callback(err error) {
 	unit.callback(err)
 }
 
-func (unit *downloadUnit) Handle() {
-	unit.callback(unit.simple())
+func (unit *downloadUnit) Handle(ctx context.Context) {
+	fn := unit.simple
+	if len(unit.local.badRanges) > 0 {
+		fn = unit.repair
+	}
+	unit.callback(unit.shared.config.Retry.Download.do(ctx, unit.log, func() error {
+		return fn(ctx)
+	}))
 }
 
-func (unit *downloadUnit) simple() error {
+func (unit *downloadUnit) simple(ctx context.Context) error {
 	unit.log.INFO.Printf("downloading %s to %s", unit.remote.path, unit.local.path)
 	if *flagDryRun {
 		unit.log.WARN.Println("dry run: skipping download")
 		return nil
 	}
 
-	// we are dialing a new ssh connection here so that
+	parent := path.Dir(unit.local.path)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		unit.log.ERROR.Printf("failed to create parent directory %q: %s", parent, err)
+		return errors.Wrap(err, "failed to create parent directory")
+	}
+
+	segments := 1
+	if unit.remote.size >= uint64(unit.shared.config.Local.SegmentThreshold) {
+		segments = unit.shared.config.Local.Segments
+	}
+
+	partial, err := openPartialFile(unit.log, unit.local, unit.remote, segments)
+	if err != nil {
+		unit.log.ERROR.Printf("failed to open partial file for %q: %s", unit.local.path, err)
+		return err
+	}
+	defer partial.Close()
+
+	done := partial.Done()
+	if done > 0 {
+		unit.log.INFO.Printf("resuming download of %s at %d of %d bytes", unit.remote.path, done, unit.remote.size)
+	}
+
+	pb := unit.shared.NewProgressBar(
+		int64(unit.remote.size),
+		fmt.Sprintf("downloading %s", unit.fileUnit.file.Path),
+	)
+	pb.SetCurrent(done)
+	pb.DecoratorAverageAdjust(time.Now())
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for idx, seg := range partial.Segments() {
+		if seg.remaining() == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(idx int, seg partialSegment) {
+			defer wg.Done()
+			if err := unit.downloadSegment(ctx, partial, pb, idx, seg); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(idx, seg)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		pb.Abort(true)
+		if err := partial.Checkpoint(); err != nil {
+			unit.log.WARN.Printf("failed to record download progress, discarding partial file: %s", err)
+			partial.Discard()
+		} else if partial.Done() == 0 {
+			partial.Discard()
+		} else {
+			unit.log.INFO.Printf("keeping %d bytes of %s to resume later", partial.Done(), partial.path)
+		}
+		return firstErr
+	}
+
+	if err := partial.Commit(unit.pieceCheck(ctx)); err != nil {
+		unit.log.ERROR.Printf("failed to move %q into place: %s", partial.path, err)
+		return err
+	}
+
+	return nil
+}
+
+// downloadSegment copies the unfinished part of one segment of the remote
+// file into the partial file over its own pooled connection.
+func (unit *downloadUnit) downloadSegment(ctx context.Context, partial *partialFile, pb *mpb.Bar, idx int, seg partialSegment) (err error) {
+	// over ssh each segment gets its own connection so that
 	// a) we do not block the main ssh connection
 	// b) we get better throughput
 
-	conn, err := unit.shared.sftpClientPool.Get(unit.log.DEBUG)
+	fs, release, err := unit.shared.remote.Transfer(ctx, unit.log.DEBUG)
 	if err != nil {
 		unit.log.ERROR.Printf("failed to dial ssh connection: %s", err)
-		return errors.Wrap(err, "failed to dial ssh connection")
+		return err
 	}
-	defer unit.shared.sftpClientPool.Put(conn)
+	defer func() { release(err) }()
 
-	parent := path.Dir(unit.local.path)
-	if err := os.MkdirAll(parent, 0755); err != nil {
-		unit.log.ERROR.Printf("failed to create parent directory %q: %s", parent, err)
-		return errors.Wrap(err, "failed to create parent directory")
+	remoteFile, err := fs.Open(unit.remote.path)
+	if err != nil {
+		unit.log.ERROR.Printf("failed to open remote file %q: %s", unit.remote.path, err)
+		return errors.Wrap(err, "failed to open remote file")
 	}
+	defer remoteFile.Close()
+
+	offset := seg.Start + seg.Done
+	n := seg.remaining()
+	unit.log.DEBUG.Printf("segment %d: copying %d bytes at %d", idx, n, offset)
 
-	localFile, err := os.Create(unit.local.path)
+	// a large buffer lets the sftp client pipeline its read requests
+	buf := make([]byte, kSegmentBuffer)
+	pw := pb.ProxyWriter(partial.SegmentWriter(idx))
+	src := contextReader{ctx, io.NewSectionReader(remoteFile, offset, n)}
+	copied, err := io.CopyBuffer(pw, src, buf)
+	atomic.AddInt64(&unit.transferred, copied)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return errors.Wrap(ctxErr, "download cancelled")
+	}
 	if err != nil {
-		unit.log.ERROR.Printf("failed to create local file %q: %s", unit.local.path, err)
-		return errors.Wrap(err, "failed to create local file")
+		unit.log.ERROR.Printf("failed to copy remote file %q to local file %q: %s", unit.remote.path, partial.path, err)
+		return err
+	}
+	if copied != n {
+		// the remote file is shorter than it was when we sized it; the
+		// retry policy treats this like a dropped connection
+		unit.log.ERROR.Printf("copied %d of %d bytes of remote file %q", copied, n, unit.remote.path)
+		return errors.Wrapf(io.ErrUnexpectedEOF, "segment %d ended after %d of %d bytes", idx, copied, n)
+	}
+
+	return nil
+}
+
+// repair re-fetches only the byte ranges that failed piece verification and
+// patches them into the existing local file in place.
+func (unit *downloadUnit) repair(ctx context.Context) (err error) {
+	var total int64
+	for _, r := range unit.local.badRanges {
+		total += r.end - r.start
+	}
+
+	unit.log.INFO.Printf("repairing %d bytes in %d range(s) of %s", total, len(unit.local.badRanges), unit.local.path)
+	if *flagDryRun {
+		unit.log.WARN.Println("dry run: skipping repair")
+		return nil
+	}
+
+	fs, release, err := unit.shared.remote.Transfer(ctx, unit.log.DEBUG)
+	if err != nil {
+		unit.log.ERROR.Printf("failed to dial ssh connection: %s", err)
+		return err
+	}
+	defer func() { release(err) }()
+
+	localFile, err := os.OpenFile(unit.local.path, os.O_RDWR, 0)
+	if err != nil {
+		unit.log.ERROR.Printf("failed to open local file %q: %s", unit.local.path, err)
+		return errors.Wrap(err, "failed to open local file")
 	}
 	defer localFile.Close()
 
-	remoteFile, err := conn.sftpClient.Open(unit.remote.path)
+	remoteFile, err := fs.Open(unit.remote.path)
 	if err != nil {
 		unit.log.ERROR.Printf("failed to open remote file %q: %s", unit.remote.path, err)
 		return errors.Wrap(err, "failed to open remote file")
@@ -68,17 +213,96 @@ func (unit *downloadUnit) simple() error {
 	defer remoteFile.Close()
 
 	pb := unit.shared.NewProgressBar(
-		int64(unit.remote.size),
-		fmt.Sprintf("downloading %s", unit.fileUnit.file.Path),
+		total,
+		fmt.Sprintf("repairing %s", unit.fileUnit.file.Path),
 	)
 
-	pw := pb.ProxyWriter(localFile)
-	defer pw.Close()
+	for _, r := range unit.local.badRanges {
+		unit.log.DEBUG.Printf("patching bytes %d-%d", r.start, r.end)
+		n := r.end - r.start
+		src := pb.ProxyReader(contextReader{ctx, io.NewSectionReader(remoteFile, r.start, n)})
+		copied, err := io.CopyN(io.NewOffsetWriter(localFile, r.start), src, n)
+		atomic.AddInt64(&unit.transferred, copied)
+		if err != nil {
+			pb.Abort(true)
+			unit.log.ERROR.Printf("failed to patch bytes %d-%d of %q: %s", r.start, r.end, unit.local.path, err)
+			return errors.Wrap(err, "failed to patch local file")
+		}
+	}
+
+	if err := localFile.Sync(); err != nil {
+		pb.Abort(true)
+		unit.log.ERROR.Printf("failed to sync local file %q: %s", unit.local.path, err)
+		return errors.Wrap(err, "failed to sync local file")
+	}
+
+	return unit.recheck(ctx, localFile)
+}
+
+// pieceVerifier returns a verifier for the file, or nil if the torrent
+// metainfo cannot verify it.
+func (unit *downloadUnit) pieceVerifier() *pieceVerifyUnit {
+	mi := unit.fileUnit.torrentUnit.metainfo
+	if mi == nil {
+		return nil
+	}
+	file, ok := mi.file(unit.fileUnit.file.Path)
+	if !ok || uint64(file.length) != unit.remote.size {
+		return nil
+	}
+
+	return &pieceVerifyUnit{
+		shared:       unit.shared,
+		log:          unit.log,
+		fileUnit:     unit.fileUnit,
+		metainfo:     mi,
+		file:         file,
+		fileMetadata: &unit.local,
+	}
+}
+
+// pieceCheck returns a check of a downloaded file against the torrent piece
+// hashes, or nil if there are none for it.
+func (unit *downloadUnit) pieceCheck(ctx context.Context) func(io.ReaderAt) error {
+	verify := unit.pieceVerifier()
+	if verify == nil {
+		return nil
+	}
+
+	return func(local io.ReaderAt) error {
+		unit.log.DEBUG.Println("verifying downloaded pieces")
+		bad, err := verify.recheck(ctx, local, []byteRange{{0, verify.file.length}})
+		if err != nil {
+			unit.log.ERROR.Printf("failed to verify downloaded pieces of %q: %s", unit.local.path, err)
+			return errors.Wrap(err, "failed to verify downloaded pieces")
+		}
+		if len(bad) > 0 {
+			unit.log.ERROR.Printf("%d range(s) of the download of %q mismatch", len(bad), unit.local.path)
+			return errors.Errorf("%d range(s) of the download mismatch torrent piece hashes", len(bad))
+		}
+		unit.hash = state.HashPieces
+		return nil
+	}
+}
+
+// recheck verifies the repaired pieces again.
+func (unit *downloadUnit) recheck(ctx context.Context, localFile io.ReaderAt) error {
+	verify := unit.pieceVerifier()
+	if verify == nil {
+		return errors.New("cannot verify repair without torrent metainfo")
+	}
 
-	_, err = io.Copy(pw, remoteFile)
+	bad, err := verify.recheck(ctx, localFile, unit.local.badRanges)
 	if err != nil {
-		unit.log.ERROR.Printf("failed to copy remote file %q to local file %q: %s", unit.remote.path, unit.local.path, err)
+		unit.log.ERROR.Printf("failed to verify repaired pieces of %q: %s", unit.local.path, err)
+		return errors.Wrap(err, "failed to verify repaired pieces")
+	}
+	if len(bad) > 0 {
+		unit.log.ERROR.Printf("%d range(s) of %q still mismatch after repair", len(bad), unit.local.path)
+		return errors.Errorf("%d range(s) still mismatch after repair", len(bad))
 	}
 
-	return err
+	unit.log.INFO.Println("repaired pieces match torrent piece hashes")
+	unit.hash = state.HashPieces
+	return nil
 }
@@ -2,13 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"github.com/demosdemon/seedbox-sync/lib/logging"
-	"github.com/mrobinsn/go-rtorrent/rtorrent"
+	"github.com/demosdemon/seedbox-sync/lib/state"
 )
 
 var _ Handler = (*fileUnit)(nil)
@@ -19,31 +21,42 @@ type fileUnit struct {
 	name        string
 	torrentUnit *torrentUnit
 	manyFiles   bool
-	file        rtorrent.File
+	file        torrentFile
 	index       int
 	callback    func(error)
 }
 
 type fileMetadata struct {
-	path   string
-	size   uint64
-	exists bool
-	md5sum []byte
+	path    string
+	size    uint64
+	modTime time.Time
+	exists  bool
+	md5sum  []byte
+
+	// set by pieceVerifyUnit
+	verified  bool
+	badRanges []byteRange
 }
 
 func (unit *fileUnit) statRemote() (fileMetadata, error) {
 	var metadata fileMetadata
-	metadata.path = path.Join(unit.torrentUnit.torrent.Path, unit.file.Path)
+	metadata.path = unit.file.Remote
 	metadata.size = uint64(unit.file.Size)
 
 	unit.log.DEBUG.Printf("statRemote(%s)", metadata.path)
-	stat, err := unit.shared.sftpClient.Stat(metadata.path)
+	fs, err := unit.shared.remote.FS()
+	if err != nil {
+		return metadata, err
+	}
+
+	stat, err := fs.Stat(metadata.path)
 	if err != nil {
 		unit.log.ERROR.Printf("remote: failed to stat remote file: %s", err)
 		return metadata, err
 	}
 
 	metadata.exists = true
+	metadata.modTime = stat.ModTime()
 
 	if uint64(stat.Size()) != metadata.size {
 		unit.log.ERROR.Printf("remote: size mismatch: %d != %d", stat.Size(), metadata.size)
@@ -56,15 +69,16 @@ func (unit *fileUnit) statRemote() (fileMetadata, error) {
 func (unit *fileUnit) statLocal() (fileMetadata, error) {
 	var metadata fileMetadata
 	if unit.manyFiles {
-		metadata.path = path.Join(unit.shared.config.Local.Destination, unit.torrentUnit.torrent.Name, unit.file.Path)
+		metadata.path = path.Join(unit.torrentUnit.destination, unit.torrentUnit.torrent.Name, unit.file.Path)
 	} else {
-		metadata.path = path.Join(unit.shared.config.Local.Destination, unit.file.Path)
+		metadata.path = path.Join(unit.torrentUnit.destination, unit.file.Path)
 	}
 	unit.log.DEBUG.Printf("statLocal(%s)", metadata.path)
 	stat, err := os.Stat(metadata.path)
 	if err == nil {
 		metadata.exists = true
 		metadata.size = uint64(stat.Size())
+		metadata.modTime = stat.ModTime()
 	}
 	if err != nil && os.IsNotExist(err) {
 		err = nil
@@ -75,22 +89,75 @@ func (unit *fileUnit) statLocal() (fileMetadata, error) {
 	return metadata, err
 }
 
-func (unit *fileUnit) doDownload(remote, local fileMetadata) {
-	unit.shared.downloadHandler.Send(&downloadUnit{
+func (unit *fileUnit) doDownload(ctx context.Context, remote, local fileMetadata) {
+	download := &downloadUnit{
 		shared:   unit.shared,
 		log:      unit.shared.NewNotepad(fmt.Sprintf("%s download", unit.name)),
 		fileUnit: unit,
 		local:    local,
 		remote:   remote,
-		callback: unit.callback,
+	}
+	download.callback = func(err error) {
+		if err != nil || *flagDryRun {
+			unit.callback(err)
+			return
+		}
+		if download.hash != state.HashNone {
+			unit.recordState(local.path, download.hash, download.transferred)
+			unit.callback(nil)
+			return
+		}
+
+		// there are no piece hashes for the file, so compare md5sums
+		lstat, err := unit.statLocal()
+		if err != nil {
+			unit.callback(err)
+			return
+		}
+		unit.compareMd5sums(ctx, remote, lstat, download)
+	}
+	unit.shared.downloadHandler.Send(download)
+}
+
+// knownGood reports whether the local file has a hash-checked state record.
+func (unit *fileUnit) knownGood(local fileMetadata) bool {
+	record, err := unit.shared.state.File(unit.torrentUnit.torrent.Hash, unit.file.Path)
+	if err != nil {
+		unit.log.WARN.Printf("failed to read sync state: %s", err)
+		return false
+	}
+	return record != nil && record.Hash != state.HashNone && record.Matches(local.size, local.modTime)
+}
+
+// recordState saves the state of a verified or transferred local file.
+func (unit *fileUnit) recordState(localPath, hash string, transferred int64) {
+	if *flagDryRun {
+		return
+	}
+
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		unit.log.WARN.Printf("failed to stat %s to record sync state: %s", localPath, err)
+		return
+	}
+
+	err = unit.shared.state.PutFile(unit.torrentUnit.torrent.Hash, unit.file.Path, state.File{
+		Size:        uint64(stat.Size()),
+		ModTime:     stat.ModTime(),
+		Hash:        hash,
+		Transferred: transferred,
+		SyncedAt:    time.Now(),
 	})
+	if err != nil {
+		unit.log.WARN.Printf("failed to record sync state: %s", err)
+	}
 }
 
 func (unit *fileUnit) Callback(err error) {
 	unit.callback(err)
 }
 
-func (unit *fileUnit) Handle() {
+func (unit *fileUnit) Handle(ctx context.Context) {
 	rstat, err := unit.statRemote()
 	if err != nil {
 		unit.callback(err)
@@ -105,56 +172,163 @@ func (unit *fileUnit) Handle() {
 
 	if !lstat.exists {
 		unit.log.INFO.Printf("Local file %s does not exist, downloading", lstat.path)
-		unit.doDownload(rstat, lstat)
+		unit.doDownload(ctx, rstat, lstat)
 		return
 	}
 
 	if lstat.size != rstat.size {
 		unit.log.INFO.Printf("Local file %s size mismatch, downloading", lstat.path)
-		unit.doDownload(rstat, lstat)
+		unit.doDownload(ctx, rstat, lstat)
 		return
 	}
 
-	errCh := make(chan error)
+	if unit.knownGood(lstat) {
+		unit.log.INFO.Println("local file matches recorded sync state, skipping verification")
+		unit.callback(nil)
+		return
+	}
+
+	if mi := unit.torrentUnit.metainfo; mi != nil {
+		file, ok := mi.file(unit.file.Path)
+		switch {
+		case !ok:
+			unit.log.WARN.Println("file not found in torrent metainfo, falling back to md5sum")
+		case uint64(file.length) != rstat.size:
+			unit.log.WARN.Printf("file length %d in torrent metainfo differs from remote size %d, falling back to md5sum", file.length, rstat.size)
+		default:
+			unit.verifyPieces(ctx, rstat, lstat, mi, file)
+			return
+		}
+	}
+
+	unit.compareMd5sums(ctx, rstat, lstat, nil)
+}
+
+// checkResult carries the metadata a check unit filled in.
+type checkResult struct {
+	metadata fileMetadata
+	err      error
+}
+
+// sendCheck returns the metadata for a check unit and its callback.
+func sendCheck(metadata fileMetadata, results chan<- checkResult) (*fileMetadata, func(error)) {
+	owned := metadata
+	return &owned, func(err error) {
+		results <- checkResult{owned, err}
+	}
+}
+
+// collectChecks waits for one result per channel, in channel order.
+func collectChecks(ctx context.Context, results ...<-chan checkResult) ([]fileMetadata, error) {
+	metadata := make([]fileMetadata, len(results))
+	var errs []error
+	for idx, ch := range results {
+		checks, err := ExactChannel(ctx, ch, 1)
+		if err != nil {
+			return nil, err
+		}
+		metadata[idx] = checks[0].metadata
+		errs = append(errs, checks[0].err)
+	}
+	return metadata, errors.Join(errs...)
+}
+
+func (unit *fileUnit) verifyPieces(ctx context.Context, rstat, lstat fileMetadata, mi *metainfo, file metainfoFile) {
+	// buffered so the verify unit never blocks if we stop waiting
+	results := make(chan checkResult, 1)
+
+	metadata, callback := sendCheck(lstat, results)
+	unit.shared.verifyHandler.Send(&pieceVerifyUnit{
+		shared:       unit.shared,
+		log:          unit.shared.NewNotepad(fmt.Sprintf("%s verify", unit.name)),
+		fileUnit:     unit,
+		metainfo:     mi,
+		file:         file,
+		fileMetadata: metadata,
+		callback:     callback,
+	})
+
+	waitCtx, cancel := unit.shared.waitContext(ctx)
+	unit.log.DEBUG.Println("waiting for piece verification")
+	go func() {
+		defer cancel()
+
+		checked, err := collectChecks(waitCtx, results)
+		if err != nil {
+			unit.log.ERROR.Printf("error verifying pieces: %s", err)
+			unit.callback(err)
+			return
+		}
+		lstat := checked[0]
+
+		if len(lstat.badRanges) == 0 {
+			unit.log.INFO.Println("local file matches torrent piece hashes")
+			unit.recordState(lstat.path, state.HashPieces, 0)
+			unit.callback(nil)
+			return
+		}
 
+		unit.log.INFO.Printf("local file has %d corrupt range(s), repairing", len(lstat.badRanges))
+		unit.doDownload(ctx, rstat, lstat)
+	}()
+}
+
+// compareMd5sums checks the local md5sum against the remote one.
+func (unit *fileUnit) compareMd5sums(ctx context.Context, rstat, lstat fileMetadata, download *downloadUnit) {
+	// buffered so the md5sum units never block if we stop waiting
+	localResults := make(chan checkResult, 1)
+	remoteResults := make(chan checkResult, 1)
+
+	localMetadata, localCallback := sendCheck(lstat, localResults)
 	unit.shared.localMd5sumHandler.Send(&localMd5sumUnit{
 		shared:       unit.shared,
 		log:          unit.shared.NewNotepad(fmt.Sprintf("%s local md5sum", unit.name)),
 		fileUnit:     unit,
-		fileMetadata: &lstat,
-		callback: func(err error) {
-			errCh <- err
-		},
+		fileMetadata: localMetadata,
+		callback:     localCallback,
 	})
 
+	remoteMetadata, remoteCallback := sendCheck(rstat, remoteResults)
 	unit.shared.remoteMd5sumHandler.Send(&remoteMd5sumUnit{
 		shared:       unit.shared,
 		log:          unit.shared.NewNotepad(fmt.Sprintf("%s remote md5sum", unit.name)),
 		fileUnit:     unit,
-		fileMetadata: &rstat,
-		callback: func(err error) {
-			errCh <- err
-		},
+		fileMetadata: remoteMetadata,
+		callback:     remoteCallback,
 	})
 
+	waitCtx, cancel := unit.shared.waitContext(ctx)
 	unit.log.DEBUG.Println("waiting for md5sum values")
 	go func() {
-		errArr, err := ExactChannel(errCh, 2)
-		err = errors.Join(append(errArr, err)...)
+		defer cancel()
 
+		checked, err := collectChecks(waitCtx, localResults, remoteResults)
 		if err != nil {
 			unit.log.ERROR.Printf("error getting md5sums: %s", err)
 			unit.callback(err)
 			return
 		}
+		lstat, rstat := checked[0], checked[1]
+
+		var transferred int64
+		if download != nil {
+			transferred = download.transferred
+		}
 
 		if bytes.Equal(lstat.md5sum, rstat.md5sum) {
 			unit.log.INFO.Println("local file md5sum matches remote")
+			unit.recordState(lstat.path, state.HashMd5, transferred)
 			unit.callback(nil)
 			return
 		}
 
+		if download != nil {
+			unit.log.ERROR.Println("downloaded file md5sum mismatch")
+			unit.callback(fmt.Errorf("downloaded file %s does not match the remote md5sum", lstat.path))
+			return
+		}
+
 		unit.log.INFO.Println("local file md5sum mismatch, downloading")
-		unit.doDownload(rstat, lstat)
+		unit.doDownload(ctx, rstat, lstat)
 	}()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
@@ -23,11 +24,11 @@ func (unit *localMd5sumUnit) Callback(err error) {
 	unit.callback(err)
 }
 
-func (unit *localMd5sumUnit) Handle() {
-	unit.callback(unit.simple())
+func (unit *localMd5sumUnit) Handle(ctx context.Context) {
+	unit.callback(unit.simple(ctx))
 }
 
-func (unit *localMd5sumUnit) simple() error {
+func (unit *localMd5sumUnit) simple(ctx context.Context) error {
 	cmd := fmt.Sprintf("md5sum -b %s", unit.fileMetadata.path)
 	unit.log.DEBUG.Printf("local exec: %s", cmd)
 
@@ -50,8 +51,9 @@ func (unit *localMd5sumUnit) simple() error {
 	)
 
 	hash := md5.New()
-	pr := pb.ProxyReader(file)
+	pr := pb.ProxyReader(contextReader{ctx, file})
 	if _, err := io.Copy(hash, pr); err != nil {
+		pb.Abort(true)
 		unit.log.ERROR.Printf("Error hashing file %s: %s", unit.fileMetadata.path, err)
 		return err
 	}
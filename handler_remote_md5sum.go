@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
@@ -27,11 +28,13 @@ func (unit *remoteMd5sumUnit) Callback(err error) {
 	unit.callback(err)
 }
 
-func (unit *remoteMd5sumUnit) Handle() {
-	unit.callback(unit.simple())
+func (unit *remoteMd5sumUnit) Handle(ctx context.Context) {
+	unit.callback(unit.shared.config.Retry.RemoteMd5sum.do(ctx, unit.log, func() error {
+		return unit.simple(ctx)
+	}))
 }
 
-func (unit *remoteMd5sumUnit) simple() error {
+func (unit *remoteMd5sumUnit) simple(ctx context.Context) error {
 	cmd := fmt.Sprintf("md5sum -b %s", shellescape.Quote(unit.fileMetadata.path))
 	unit.log.DEBUG.Printf("remote exec: %s", cmd)
 
@@ -53,14 +56,8 @@ func (unit *remoteMd5sumUnit) simple() error {
 	)
 	defer pb.SetTotal(-1, true)
 
-	sess, err := unit.shared.sshClient.NewSession()
-	if err != nil {
-		unit.log.ERROR.Printf("Error creating new ssh session: %s", err)
-		return errors.Wrap(err, "failed to create new ssh session")
-	}
-
-	sess.Stderr = &stderrProxy{unit.shared.NewNotepad(fmt.Sprintf("%s remote md5sum stderr", unit.fileUnit.name))}
-	out, err := sess.Output(cmd)
+	stderr := &stderrProxy{unit.shared.NewNotepad(fmt.Sprintf("%s remote md5sum stderr", unit.fileUnit.name))}
+	out, err := unit.shared.remote.Run(ctx, cmd, stderr)
 	if err != nil {
 		unit.log.ERROR.Printf("Error running remote md5sum: %s", err)
 		return errors.Wrap(err, "failed to run remote md5sum")
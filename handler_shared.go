@@ -1,14 +1,14 @@
 package main
 
 import (
+	"context"
 	"io"
 	"os"
 	"sync/atomic"
-	"time"
 
 	"github.com/demosdemon/seedbox-sync/lib/logging"
 	"github.com/demosdemon/seedbox-sync/lib/pool"
-	"github.com/mrobinsn/go-rtorrent/rtorrent"
+	"github.com/demosdemon/seedbox-sync/lib/state"
 	"github.com/pkg/sftp"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
@@ -16,22 +16,37 @@ import (
 )
 
 type sharedUnit struct {
+	// stopCtx is cancelled when a shutdown begins and no new work should
+	// start; abortCtx is cancelled when in-flight work must give up.
+	stopCtx             context.Context
+	stop                context.CancelFunc
+	abortCtx            context.Context
+	abort               context.CancelFunc
+	exitCode            atomic.Int32
 	nextPriority        atomic.Uint64
 	progress            *mpb.Progress
 	fileLogger          io.Writer
 	log                 logging.Notepad
 	config              *Config
-	sftpClientPool      *pool.Pool[*pooledSftpClient]
-	sshClient           *ssh.Client
-	sftpClient          *sftp.Client
-	rtorrentClient      *rtorrent.RTorrent
+	state               *state.Store
+	remote              remoteHost
+	client              torrentClient
 	downloadHandler     *WorkQueue[*downloadUnit]
 	localMd5sumHandler  *WorkQueue[*localMd5sumUnit]
 	remoteMd5sumHandler *WorkQueue[*remoteMd5sumUnit]
+	verifyHandler       *WorkQueue[*pieceVerifyUnit]
 	fileHandler         *WorkQueue[*fileUnit]
 	torrentHandler      *WorkQueue[*torrentUnit]
 }
 
+// waitContext keeps ctx's deadline but outlives the Handle that passed it.
+func (unit *sharedUnit) waitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(unit.abortCtx, deadline)
+	}
+	return context.WithCancel(unit.abortCtx)
+}
+
 func (unit *sharedUnit) NewNotepad(prefix string) logging.Notepad {
 	return logging.New(unit.progress, unit.fileLogger, prefix)
 }
@@ -66,14 +81,20 @@ func (unit *sharedUnit) Close() {
 	unit.torrentHandler.Close()
 	unit.fileHandler.Close()
 	unit.remoteMd5sumHandler.Close()
+	unit.verifyHandler.Close()
 	unit.localMd5sumHandler.Close()
 	unit.downloadHandler.Close()
-	unit.log.DEBUG.Println("Closing sshClient")
-	unit.sshClient.Close()
+	unit.log.DEBUG.Println("Closing remote host")
+	unit.remote.Close()
 	unit.progress.Wait()
+	if err := unit.state.Close(); err != nil {
+		unit.log.WARN.Printf("Error closing state database: %s", err)
+	}
 	if w, ok := unit.fileLogger.(*os.File); ok {
 		w.Close()
 	}
+	unit.stop()
+	unit.abort()
 }
 
 func NewSharedUnit(configPath string) *sharedUnit {
@@ -81,6 +102,8 @@ func NewSharedUnit(configPath string) *sharedUnit {
 	var err error
 
 	shared.nextPriority.Store(3)
+	shared.stopCtx, shared.stop = context.WithCancel(context.Background())
+	shared.abortCtx, shared.abort = context.WithCancel(context.Background())
 
 	// Progress writer must be configured before any logging output is generated
 	shared.progress = mpb.New(
@@ -106,32 +129,30 @@ func NewSharedUnit(configPath string) *sharedUnit {
 		shared.log.FATAL.Panicf("Error loading config: %s", err)
 	}
 
-	shared.sftpClientPool = pool.NewPool(
-		func(log pool.Printer) (*pooledSftpClient, error) {
-			return newPooledSftpClient(shared.config, log)
-		},
-		pool.OptionDropItem(func(c *pooledSftpClient) {
-			c.sshClient.Close()
-		}),
-		pool.OptionMaxIdle[*pooledSftpClient](shared.config.Local.DownloadThreads),
-		pool.OptionMaxIdleTime[*pooledSftpClient](time.Minute),
-		pool.OptionDebug[*pooledSftpClient](shared.log.TRACE),
-	)
+	shared.handleSignals()
 
-	conn, err := shared.sftpClientPool.Get(shared.log.DEBUG)
+	shared.state, err = state.Open(shared.config.Local.StateDB)
 	if err != nil {
-		shared.log.FATAL.Panicf("Error connecting to ssh: %s", err)
+		shared.log.FATAL.Panicf("Error opening state database: %s", err)
 	}
 
-	shared.sshClient = conn.sshClient
-	shared.sftpClient = conn.sftpClient
+	shared.remote, err = shared.config.newRemoteHost(shared.NewNotepad(shared.config.Remote.Transport))
+	if err != nil {
+		shared.log.FATAL.Panicf("Error connecting to remote host: %s", err)
+	}
+
+	shared.client, err = shared.config.TorrentClient(shared.NewNotepad(shared.config.Remote.Client), shared.remote, shared.state)
+	if err != nil {
+		shared.log.FATAL.Panicf("Error creating torrent client: %s", err)
+	}
 
-	shared.rtorrentClient = shared.config.RTorrentClient(shared.NewNotepad("rtorrent"), shared.sshClient)
-	shared.downloadHandler = shared.config.downloadHandlers(shared.NewNotepad)
-	shared.localMd5sumHandler = shared.config.localMd5sumHandlers(shared.NewNotepad)
-	shared.remoteMd5sumHandler = shared.config.remoteMd5sumHandlers(shared.NewNotepad)
-	shared.fileHandler = shared.config.fileHandlers(shared.NewNotepad)
-	shared.torrentHandler = shared.config.torrentHandlers(shared.NewNotepad)
+	qctx := queueContext{stop: shared.stopCtx, work: shared.abortCtx}
+	shared.downloadHandler = shared.config.downloadHandlers(qctx, shared.NewNotepad)
+	shared.localMd5sumHandler = shared.config.localMd5sumHandlers(qctx, shared.NewNotepad)
+	shared.remoteMd5sumHandler = shared.config.remoteMd5sumHandlers(qctx, shared.NewNotepad)
+	shared.verifyHandler = shared.config.verifyHandlers(qctx, shared.NewNotepad)
+	shared.fileHandler = shared.config.fileHandlers(qctx, shared.NewNotepad)
+	shared.torrentHandler = shared.config.torrentHandlers(qctx, shared.NewNotepad)
 
 	return &shared
 }
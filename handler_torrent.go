@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"path"
 
 	"github.com/demosdemon/seedbox-sync/lib/logging"
-	"github.com/mrobinsn/go-rtorrent/rtorrent"
 )
 
 var _ Handler = (*torrentUnit)(nil)
@@ -14,32 +15,98 @@ type torrentUnit struct {
 	shared   *sharedUnit
 	log      logging.Notepad
 	name     string
-	torrent  rtorrent.Torrent
+	torrent  torrentInfo
 	index    int
+	metainfo *metainfo
 	callback func(error)
+
+	// local directory the torrent is synced into
+	destination string
+	// set once the torrent is known to be marked as synced
+	synced bool
+
+	trackerURLs     []string
+	trackersFetched bool
+
+	// remote paths of the torrent's files, keyed by their path in the torrent
+	remotePaths map[string]string
+}
+
+// remotePath returns where a file of the torrent is stored on the remote.
+func (unit *torrentUnit) remotePath(file string) string {
+	if remote, ok := unit.remotePaths[file]; ok {
+		return remote
+	}
+	return path.Join(unit.torrent.Path, file)
+}
+
+// trackers returns the torrent's tracker URLs, fetching them at most once.
+func (unit *torrentUnit) trackers() ([]string, error) {
+	if !unit.trackersFetched {
+		urls, err := unit.shared.client.Trackers(unit.torrent)
+		if err != nil {
+			return nil, err
+		}
+		unit.trackerURLs, unit.trackersFetched = urls, true
+	}
+	return unit.trackerURLs, nil
 }
 
 func (unit *torrentUnit) Callback(err error) {
 	unit.callback(err)
 }
 
-func (unit *torrentUnit) Handle() {
+func (unit *torrentUnit) Handle(ctx context.Context) {
 	fileErrors, nFiles, err := func() (chan error, int, error) {
 		if !unit.torrent.Completed {
 			unit.log.INFO.Println("skipping torrent as it has not yet completed")
 			return nil, 0, nil
 		}
 
-		if unit.torrent.Label == unit.shared.config.Remote.Rtorrent.SyncTag {
-			unit.log.INFO.Println("skipping torrent as it is labeled as synced")
+		include, rule, err := unit.shared.config.selectTorrent(unit.torrent, unit.trackers)
+		if err != nil {
+			unit.log.ERROR.Printf("failed to apply selection rules: %s", err)
+			return nil, 0, err
+		}
+		if !include {
+			unit.log.INFO.Printf("skipping torrent as it is excluded by rule %d", rule)
+			return nil, 0, nil
+		}
+
+		synced, err := unit.shared.client.IsSynced(unit.torrent)
+		if err != nil {
+			unit.log.ERROR.Printf("failed to read sync marker: %s", err)
+			return nil, 0, err
+		}
+		if synced {
+			unit.synced = true
+			unit.log.INFO.Println("skipping torrent as it is marked as synced")
 			return nil, 0, nil
 		}
 
+		tmpl := unit.shared.config.destinationTemplate(unit.torrent, rule)
+		unit.destination, err = expandDestination(tmpl, unit.torrent, unit.trackers)
+		if err != nil {
+			unit.log.ERROR.Printf("failed to expand destination %q: %s", tmpl, err)
+			return nil, 0, err
+		}
+		unit.log.DEBUG.Printf("syncing to %s", unit.destination)
+
+		if mi, err := unit.loadMetainfo(ctx); err != nil {
+			unit.log.WARN.Printf("unable to load torrent metainfo, falling back to md5sum: %s", err)
+		} else {
+			unit.metainfo = mi
+			unit.torrent.MultiFile = unit.torrent.MultiFile || mi.multiFile
+		}
+
 		unit.log.INFO.Println("listing files...")
-		files, err := unit.shared.rtorrentClient.GetFiles(unit.torrent)
+		var files []torrentFile
+		err = unit.shared.config.Retry.Client.do(ctx, unit.log, func() (err error) {
+			files, err = unit.shared.client.Files(&unit.torrent)
+			return err
+		})
 		if err != nil {
 			unit.log.ERROR.Printf("failed to list files: %s", err)
-			unit.callback(err)
 			return nil, 0, err
 		}
 
@@ -48,7 +115,12 @@ func (unit *torrentUnit) Handle() {
 		fileErrors := make(chan error, nFiles)
 
 		unit.log.INFO.Printf("found %d file(s)...", nFiles)
-		manyFiles := nFiles > 1
+		manyFiles := nFiles > 1 || unit.torrent.MultiFile
+
+		unit.remotePaths = make(map[string]string, nFiles)
+		for _, file := range files {
+			unit.remotePaths[file.Path] = file.Remote
+		}
 
 		for idx, file := range files {
 			var name string
@@ -85,10 +157,12 @@ func (unit *torrentUnit) Handle() {
 		return
 	}
 
+	waitCtx, cancel := unit.shared.waitContext(ctx)
 	unit.log.DEBUG.Println("waiting for all files to be processed...")
 	go func() {
 		var err error
 		defer func() {
+			cancel()
 			if r := recover(); r != nil {
 				err = fmt.Errorf("recovered from panic: %v", r)
 			}
@@ -97,8 +171,7 @@ func (unit *torrentUnit) Handle() {
 		}()
 
 		err = func() error {
-			fileErrorsArr, err := ExactChannel(fileErrors, nFiles)
-			close(fileErrors)
+			fileErrorsArr, err := ExactChannel(waitCtx, fileErrors, nFiles)
 			err = errors.Join(append(fileErrorsArr, err)...)
 			if err != nil {
 				unit.log.ERROR.Printf("failed to process all files: %s", err)
@@ -107,18 +180,35 @@ func (unit *torrentUnit) Handle() {
 
 			unit.log.INFO.Println("all files processed")
 			if *flagDryRun {
-				unit.log.INFO.Println("dry-run enabled, skipping update of label")
+				unit.log.INFO.Println("dry-run enabled, skipping update of sync marker")
 				return err
 			}
 
-			unit.log.INFO.Println("updating label...")
-			err = unit.shared.rtorrentClient.SetLabel(unit.torrent, unit.shared.config.Remote.Rtorrent.SyncTag)
+			unit.log.INFO.Println("updating sync marker...")
+			err = unit.shared.config.Retry.Client.do(waitCtx, unit.log, func() error {
+				return unit.shared.client.MarkSynced(unit.torrent)
+			})
 			if err != nil {
-				unit.log.ERROR.Printf("failed to set label: %s", err)
+				unit.log.ERROR.Printf("failed to mark torrent synced: %s", err)
 				return err
 			}
+			unit.synced = true
 
 			return nil
 		}()
 	}()
 }
+
+func (unit *torrentUnit) loadMetainfo(ctx context.Context) (mi *metainfo, err error) {
+	err = unit.shared.config.Retry.Client.do(ctx, unit.log, func() error {
+		file, err := unit.shared.client.Metainfo(unit.torrent)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		mi, err = readMetainfo(file)
+		return err
+	})
+	return mi, err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/pkg/errors"
+)
+
+var _ Handler = (*pieceVerifyUnit)(nil)
+
+// pieceVerifyUnit checks a local file against the torrent's piece hashes.
+type pieceVerifyUnit struct {
+	shared       *sharedUnit
+	log          logging.Notepad
+	fileUnit     *fileUnit
+	metainfo     *metainfo
+	file         metainfoFile
+	fileMetadata *fileMetadata
+	callback     func(error)
+}
+
+func (unit *pieceVerifyUnit) Callback(err error) {
+	unit.callback(err)
+}
+
+func (unit *pieceVerifyUnit) Handle(ctx context.Context) {
+	unit.callback(unit.shared.config.Retry.Verify.do(ctx, unit.log, func() error {
+		return unit.simple(ctx)
+	}))
+}
+
+func (unit *pieceVerifyUnit) simple(ctx context.Context) (err error) {
+	first, last := unit.metainfo.pieceSpan(unit.file)
+	unit.log.DEBUG.Printf("verifying pieces %d-%d of %s", first, last, unit.fileMetadata.path)
+
+	file, err := os.Open(unit.fileMetadata.path)
+	if err != nil {
+		unit.log.ERROR.Printf("Error opening file %s: %s", unit.fileMetadata.path, err)
+		return err
+	}
+	defer file.Close()
+
+	pb := unit.shared.NewProgressBar(
+		unit.file.length,
+		fmt.Sprintf("verify %s", unit.fileUnit.file.Path),
+	)
+	defer func() {
+		if err != nil {
+			pb.Abort(true)
+		}
+	}()
+
+	local := pb.ProxyReader(contextReader{ctx, file})
+
+	var bad []byteRange
+	for piece := first; piece <= last; piece++ {
+		var ok bool
+		if ok, err = unit.checkPiece(ctx, piece, local); err != nil {
+			return err
+		}
+		if !ok {
+			rel := unit.fileRange(piece)
+			unit.log.WARN.Printf("piece %d mismatch (file bytes %d-%d)", piece, rel.start, rel.end)
+			bad = appendRange(bad, rel)
+		}
+	}
+
+	unit.fileMetadata.badRanges = bad
+	unit.fileMetadata.verified = true
+	return nil
+}
+
+// recheck verifies the pieces overlapping ranges again and returns the bad ones.
+func (unit *pieceVerifyUnit) recheck(ctx context.Context, local io.ReaderAt, ranges []byteRange) ([]byteRange, error) {
+	mi := unit.metainfo
+	var bad []byteRange
+	next := 0
+	for _, r := range ranges {
+		if r.end <= r.start {
+			continue
+		}
+		first := int((unit.file.offset + r.start) / mi.pieceLength)
+		last := int((unit.file.offset + r.end - 1) / mi.pieceLength)
+		// ranges are sorted, so a piece shared by two ranges is only
+		// checked once
+		if first < next {
+			first = next
+		}
+		for piece := first; piece <= last; piece++ {
+			rel := unit.fileRange(piece)
+			ok, err := unit.checkPiece(ctx, piece, io.NewSectionReader(local, rel.start, rel.end-rel.start))
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				unit.log.WARN.Printf("piece %d still mismatches (file bytes %d-%d)", piece, rel.start, rel.end)
+				bad = appendRange(bad, rel)
+			}
+		}
+		next = last + 1
+	}
+	return bad, nil
+}
+
+// checkPiece hashes one piece, reading neighbouring files from the remote.
+func (unit *pieceVerifyUnit) checkPiece(ctx context.Context, piece int, local io.Reader) (bool, error) {
+	bounds := unit.metainfo.pieceBounds(piece)
+	fileEnd := unit.file.offset + unit.file.length
+	hash := sha1.New()
+
+	if bounds.start < unit.file.offset {
+		if err := unit.readNeighbours(ctx, hash, byteRange{bounds.start, unit.file.offset}); err != nil {
+			return false, err
+		}
+	}
+
+	rel := unit.fileRange(piece)
+	if _, err := io.CopyN(hash, local, rel.end-rel.start); err != nil {
+		unit.log.ERROR.Printf("Error reading file %s: %s", unit.fileMetadata.path, err)
+		return false, errors.Wrap(err, "failed to read local file")
+	}
+
+	if bounds.end > fileEnd {
+		if err := unit.readNeighbours(ctx, hash, byteRange{fileEnd, bounds.end}); err != nil {
+			return false, err
+		}
+	}
+
+	return bytes.Equal(hash.Sum(nil), unit.metainfo.pieces[piece][:]), nil
+}
+
+// fileRange returns the part of a piece in the file, relative to the file.
+func (unit *pieceVerifyUnit) fileRange(piece int) byteRange {
+	bounds := unit.metainfo.pieceBounds(piece)
+	start := max64(bounds.start, unit.file.offset)
+	end := min64(bounds.end, unit.file.offset+unit.file.length)
+	return byteRange{start - unit.file.offset, end - unit.file.offset}
+}
+
+// appendRange adds r to the sorted ranges, merging touching ranges.
+func appendRange(ranges []byteRange, r byteRange) []byteRange {
+	if n := len(ranges); n > 0 && ranges[n-1].end == r.start {
+		ranges[n-1].end = r.end
+		return ranges
+	}
+	return append(ranges, r)
+}
+
+// readNeighbours hashes the part of r in other files from their remote copies.
+func (unit *pieceVerifyUnit) readNeighbours(ctx context.Context, w io.Writer, r byteRange) error {
+	return unit.metainfo.overlapping(r, func(file metainfoFile, rel byteRange) error {
+		n := rel.end - rel.start
+		if file.padding {
+			_, err := io.CopyN(w, zeroReader{}, n)
+			return err
+		}
+
+		remotePath := unit.fileUnit.torrentUnit.remotePath(file.path)
+		unit.log.TRACE.Printf("reading %d bytes of neighbour %s at %d", n, remotePath, rel.start)
+
+		fs, err := unit.shared.remote.FS()
+		if err != nil {
+			return err
+		}
+
+		remote, err := fs.Open(remotePath)
+		if err != nil {
+			unit.log.ERROR.Printf("failed to open remote file %q: %s", remotePath, err)
+			return errors.Wrap(err, "failed to open remote neighbour")
+		}
+		defer remote.Close()
+
+		if _, err := io.CopyN(w, contextReader{ctx, io.NewSectionReader(remote, rel.start, n)}, n); err != nil {
+			unit.log.ERROR.Printf("failed to read remote file %q: %s", remotePath, err)
+			return errors.Wrap(err, "failed to read remote neighbour")
+		}
+		return nil
+	})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for idx := range p {
+		p[idx] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/demosdemon/seedbox-sync/lib/pool"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// serializes trust-on-first-use writes to the known_hosts file, since
+// pooled connections are dialed concurrently
+var knownHostsMu sync.Mutex
+
+// hostKeyCallback checks host keys against the configured known_hosts file.
+// The file is read for every dial so that keys recorded by one connection
+// are seen by the next.
+func (c *SshConfig) hostKeyCallback(log pool.Printer) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := c.checkHostKey(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) > 0 {
+			want := keyErr.Want[0]
+			return errors.Errorf(
+				"ssh: host key mismatch for %s: got %s %s, but %s:%d has %s %s",
+				hostname, key.Type(), fingerprint, want.Filename, want.Line, want.Key.Type(), ssh.FingerprintSHA256(want.Key),
+			)
+		}
+
+		if !c.TrustOnFirstUse {
+			return errors.Errorf(
+				"ssh: host %s is not in %s: got %s %s",
+				hostname, c.KnownHosts, key.Type(), fingerprint,
+			)
+		}
+
+		return c.trustHostKey(log, hostname, remote, key)
+	}
+}
+
+func (c *SshConfig) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if _, err := os.Stat(c.KnownHosts); os.IsNotExist(err) {
+		// an empty database, so every host is unknown
+		return &knownhosts.KeyError{}
+	}
+
+	callback, err := knownhosts.New(c.KnownHosts)
+	if err != nil {
+		return errors.Wrapf(err, "ssh: error reading %s", c.KnownHosts)
+	}
+	return callback(hostname, remote, key)
+}
+
+// host key algorithms in the order ssh prefers them, with the type of key
+// each one is verified with
+var hostKeyAlgorithmOrder = []struct{ algorithm, keyType string }{
+	{ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA256},
+	{ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA384},
+	{ssh.KeyAlgoECDSA521, ssh.KeyAlgoECDSA521},
+	{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA},
+	{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+	{ssh.KeyAlgoRSA, ssh.KeyAlgoRSA},
+	{ssh.KeyAlgoDSA, ssh.KeyAlgoDSA},
+	{ssh.KeyAlgoED25519, ssh.KeyAlgoED25519},
+}
+
+// hostKeyAlgorithms returns the host key algorithms to offer addr: those
+// whose keys are in the known_hosts file for it. Without them, a host known
+// only by its ed25519 key that prefers rsa presents the rsa key and looks
+// like a mismatch. Nil, so ssh uses its defaults, for an unknown host.
+func (c *SshConfig) hostKeyAlgorithms(addr string) []string {
+	err := c.checkHostKey(addr, &net.TCPAddr{IP: net.IPv4zero}, probeKey{})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil
+	}
+
+	known := make(map[string]bool, len(keyErr.Want))
+	for _, want := range keyErr.Want {
+		known[want.Key.Type()] = true
+	}
+
+	var algorithms []string
+	for _, algo := range hostKeyAlgorithmOrder {
+		if known[algo.keyType] {
+			algorithms = append(algorithms, algo.algorithm)
+		}
+	}
+	return algorithms
+}
+
+// probeKey has no type, so known_hosts never has it and checking it lists
+// every key known for a host.
+type probeKey struct{}
+
+func (probeKey) Type() string    { return "" }
+func (probeKey) Marshal() []byte { return nil }
+
+func (probeKey) Verify([]byte, *ssh.Signature) error {
+	return errors.New("ssh: probe key cannot verify signatures")
+}
+
+// trustHostKey records the key of a host seen for the first time.
+func (c *SshConfig) trustHostKey(log pool.Printer, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	// another connection may have recorded the host while we waited
+	err := c.checkHostKey(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+		return err
+	}
+
+	address := knownhosts.Normalize(hostname)
+	if c.HashKnownHosts {
+		address = knownhosts.HashHostname(address)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.KnownHosts), 0700); err != nil {
+		return errors.Wrap(err, "ssh: error creating known_hosts directory")
+	}
+
+	f, err := os.OpenFile(c.KnownHosts, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "ssh: error opening %s", c.KnownHosts)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{address}, key)); err != nil {
+		return errors.Wrapf(err, "ssh: error writing %s", c.KnownHosts)
+	}
+
+	log.Printf("Permanently added %s key %s for %s to %s", key.Type(), ssh.FingerprintSHA256(key), hostname, c.KnownHosts)
+	return nil
+}
+
+// expandHome replaces a leading "~/" with the user's home directory.
+func expandHome(path string) (string, error) {
+	if len(path) < 2 || path[:2] != "~/" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting user home directory: %w", err)
+	}
+	return filepath.Join(home, path[2:]), nil
+}
@@ -0,0 +1,144 @@
+package bencode
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// how deeply lists and dictionaries may nest
+const maxDepth = 64
+
+// SyntaxError describes malformed bencoded input.
+type SyntaxError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+// Decode parses a single bencoded value. Integers decode to int64, byte
+// strings to string, lists to []any and dictionaries to map[string]any.
+func Decode(data []byte) (any, error) {
+	d := decoder{data: data}
+	v, err := d.value()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, d.errorf("trailing data")
+	}
+	return v, nil
+}
+
+type decoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (d *decoder) errorf(format string, args ...any) error {
+	return &SyntaxError{Offset: d.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *decoder) value() (any, error) {
+	if d.pos >= len(d.data) {
+		return nil, d.errorf("unexpected end of input")
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.integer('e')
+	case c == 'l', c == 'd':
+		if d.depth >= maxDepth {
+			return nil, d.errorf("nesting deeper than %d", maxDepth)
+		}
+		d.pos++
+		d.depth++
+		defer func() { d.depth-- }()
+		if c == 'l' {
+			return d.list()
+		}
+		return d.dict()
+	case c >= '0' && c <= '9':
+		return d.string()
+	default:
+		return nil, d.errorf("unexpected byte %q", c)
+	}
+}
+
+func (d *decoder) integer(end byte) (int64, error) {
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] != end {
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return 0, d.errorf("unterminated integer")
+	}
+
+	n, err := strconv.ParseInt(string(d.data[start:d.pos]), 10, 64)
+	if err != nil {
+		return 0, &SyntaxError{Offset: start, Msg: "invalid integer"}
+	}
+	d.pos++
+	return n, nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.integer(':')
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || int64(len(d.data)-d.pos) < n {
+		return "", d.errorf("invalid string length %d", n)
+	}
+
+	s := string(d.data[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+	return s, nil
+}
+
+func (d *decoder) list() ([]any, error) {
+	list := []any{}
+	for {
+		if d.pos >= len(d.data) {
+			return nil, d.errorf("unterminated list")
+		}
+		if d.data[d.pos] == 'e' {
+			d.pos++
+			return list, nil
+		}
+
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+}
+
+func (d *decoder) dict() (map[string]any, error) {
+	dict := map[string]any{}
+	for {
+		if d.pos >= len(d.data) {
+			return nil, d.errorf("unterminated dictionary")
+		}
+		if d.data[d.pos] == 'e' {
+			d.pos++
+			return dict, nil
+		}
+
+		key, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		dict[key] = v
+	}
+}
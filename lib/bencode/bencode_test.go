@@ -0,0 +1,99 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  any
+	}{
+		{"integer", "i42e", int64(42)},
+		{"negative integer", "i-7e", int64(-7)},
+		{"string", "4:spam", "spam"},
+		{"empty string", "0:", ""},
+		{"binary string", "3:\x00\xff:", "\x00\xff:"},
+		{"empty list", "le", []any{}},
+		{"empty dict", "de", map[string]any{}},
+		{"list", "l4:spami42ee", []any{"spam", int64(42)}},
+		{
+			"nested",
+			"d4:infod5:filesld6:lengthi10e4:pathl1:a1:beee4:name3:fooe4:listlli1eeleee",
+			map[string]any{
+				"info": map[string]any{
+					"files": []any{
+						map[string]any{
+							"length": int64(10),
+							"path":   []any{"a", "b"},
+						},
+					},
+					"name": "foo",
+				},
+				"list": []any{[]any{int64(1)}, []any{}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("Decode(%q) error: %s", tt.input, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode(%q) = %#v, want %#v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"unknown type", "x"},
+		{"unterminated integer", "i42"},
+		{"invalid integer", "i4x2e"},
+		{"empty integer", "ie"},
+		{"truncated string", "5:spa"},
+		{"string without colon", "5"},
+		{"unterminated list", "l4:spam"},
+		{"unterminated dict", "d3:foo3:bar"},
+		{"dict without value", "d3:fooe"},
+		{"dict with integer key", "di1e3:fooe"},
+		{"trailing data", "i1ei2e"},
+		{"truncated nested", "d4:infod4:name3:fo"},
+		{"too deep", strings.Repeat("l", maxDepth+1) + strings.Repeat("e", maxDepth+1)},
+		{"deep truncated", strings.Repeat("l", 1<<20)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("Decode(%q) = %#v, want error", tt.input, got)
+			}
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Decode(%q) error %T is not a *SyntaxError", tt.input, err)
+			}
+			if syntaxErr.Offset < 0 || syntaxErr.Offset > len(tt.input) {
+				t.Errorf("Decode(%q) error offset %d out of range", tt.input, syntaxErr.Offset)
+			}
+		})
+	}
+}
+
+func TestDecodemaxDepth(t *testing.T) {
+	input := strings.Repeat("l", maxDepth) + strings.Repeat("e", maxDepth)
+	if _, err := Decode([]byte(input)); err != nil {
+		t.Errorf("Decode of %d nested lists: %s", maxDepth, err)
+	}
+}
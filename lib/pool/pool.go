@@ -14,11 +14,12 @@ type Printer interface {
 }
 
 type Pool[T any] struct {
-	wg1          *sync.WaitGroup // waits for the 3 channels to drain
+	wg1          *sync.WaitGroup // waits for the 4 channels to drain
 	wg2          *sync.WaitGroup // waits for the worker goroutine to exit
 	closeReq     chan<- struct{}
 	newItemReq   chan<- request[T]
 	putItemReq   chan<- T
+	dropItemReq  chan<- T
 	updateConfig chan<- Option[T]
 }
 
@@ -39,10 +40,11 @@ func NewPool[T any](newItem func(Printer) (T, error), opts ...Option[T]) *Pool[T
 		closeReq     = make(chan struct{})
 		newItemReq   = make(chan request[T])
 		putItemReq   = make(chan T)
+		dropItemReq  = make(chan T)
 		updateConfig = make(chan Option[T])
 	)
 
-	wg1.Add(3)
+	wg1.Add(4)
 	wg2.Add(1)
 	go func() {
 		defer wg2.Done()
@@ -83,6 +85,18 @@ func NewPool[T any](newItem func(Printer) (T, error), opts ...Option[T]) *Pool[T
 				// excess items will be dropped at the top of the loop
 				state.items = append(state.items, idle[T]{item, time.Now()})
 
+			case item, ok := <-dropItemReq:
+				if !ok {
+					wg1.Done()
+					dropItemReq = nil
+					continue
+				}
+
+				state.Printf("dropping broken item: %v", item)
+				if state.dropItem != nil {
+					state.dropItem(item)
+				}
+
 			case opt, ok := <-updateConfig:
 				if !ok {
 					wg1.Done()
@@ -105,6 +119,7 @@ func NewPool[T any](newItem func(Printer) (T, error), opts ...Option[T]) *Pool[T
 		closeReq:     closeReq,
 		newItemReq:   newItemReq,
 		putItemReq:   putItemReq,
+		dropItemReq:  dropItemReq,
 		updateConfig: updateConfig,
 	}
 }
@@ -118,6 +133,7 @@ func (p *Pool[T]) Close() {
 	)
 	close(p.updateConfig)
 	close(p.putItemReq)
+	close(p.dropItemReq)
 	close(p.newItemReq)
 	p.wg1.Wait()
 	close(p.closeReq)
@@ -135,6 +151,12 @@ func (p *Pool[T]) Put(item T) {
 	p.putItemReq <- item
 }
 
+// Drop discards an item taken from the pool instead of returning it, e.g.
+// because its connection failed.
+func (p *Pool[T]) Drop(item T) {
+	p.dropItemReq <- item
+}
+
 func (p *Pool[T]) UpdateConfig(opt ...Option[T]) {
 	for _, o := range opt {
 		p.updateConfig <- o
@@ -0,0 +1,392 @@
+// Package rtorrent is a small rtorrent XML-RPC client that batches its
+// queries, so that listing thousands of torrents takes a handful of
+// requests instead of one per torrent.
+package rtorrent
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/mrobinsn/go-rtorrent/xmlrpc"
+	"github.com/pkg/errors"
+)
+
+// ViewMain lists every torrent.
+const ViewMain = "main"
+
+var numberedCustomField = regexp.MustCompile(`^custom[1-5]$`)
+
+type Client struct {
+	xmlrpc *xmlrpc.Client
+}
+
+func New(addr string, httpClient *http.Client) *Client {
+	return &Client{xmlrpc.NewClientWithHTTPClient(addr, httpClient)}
+}
+
+// Call calls a single method and returns its result.
+func (c *Client) Call(method string, args ...any) (any, error) {
+	results, err := c.xmlrpc.Call(method, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s XMLRPC call failed", method)
+	}
+	if values, ok := results.([]any); ok && len(values) > 0 {
+		return values[0], nil
+	}
+	return results, nil
+}
+
+// String calls a method that returns a string.
+func (c *Client) String(method string, args ...any) (string, error) {
+	result, err := c.Call(method, args...)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := result.(string); ok {
+		return value, nil
+	}
+	return "", errors.Errorf("%s: result isn't string: %v", method, result)
+}
+
+// MulticallEntry is one method call of a Multicall.
+type MulticallEntry struct {
+	Method string
+	Params []any
+}
+
+// Fault is the error returned by one call of a Multicall.
+type Fault struct {
+	Code    int
+	Message string
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("rtorrent: fault %d: %s", f.Code, f.Message)
+}
+
+// Multicall runs calls in a single system.multicall request. The result of
+// a call that failed is a *Fault.
+func (c *Client) Multicall(calls []MulticallEntry) ([]any, error) {
+	if len(calls) == 0 {
+		return nil, nil
+	}
+
+	entries := make([]any, len(calls))
+	for idx, call := range calls {
+		params := call.Params
+		if params == nil {
+			params = []any{}
+		}
+		entries[idx] = map[string]any{
+			"methodName": call.Method,
+			"params":     params,
+		}
+	}
+
+	result, err := c.Call("system.multicall", entries)
+	if err != nil {
+		return nil, err
+	}
+	rows, ok := result.([]any)
+	if !ok || len(rows) != len(calls) {
+		return nil, errors.Errorf("system.multicall: expected %d results, got %v", len(calls), result)
+	}
+
+	results := make([]any, len(rows))
+	for idx, row := range rows {
+		switch row := row.(type) {
+		case []any:
+			if len(row) > 0 {
+				results[idx] = row[0]
+			}
+		case map[string]any:
+			code, _ := row["faultCode"].(int)
+			msg, _ := row["faultString"].(string)
+			results[idx] = &Fault{code, msg}
+		default:
+			return nil, errors.Errorf("system.multicall: unexpected result %v", row)
+		}
+	}
+	return results, nil
+}
+
+// Torrent holds the fields of a download that Torrents fetches.
+type Torrent struct {
+	Hash  string
+	Name  string
+	Label string
+	// the torrent's own directory for multi-file torrents, and the
+	// directory containing the file otherwise
+	Directory string
+	Size      int64
+	Complete  bool
+	MultiFile bool
+	Started   time.Time
+	Finished  time.Time
+	// the .torrent file rtorrent keeps in its session directory
+	SessionFile string
+	Trackers    []string
+	// the custom fields requested from Torrents, keyed by field name
+	Custom map[string]string
+}
+
+var torrentFields = []string{
+	"d.hash=",
+	"d.name=",
+	"d.custom1=",
+	"d.directory=",
+	"d.size_bytes=",
+	"d.complete=",
+	"d.is_multi_file=",
+	"d.timestamp.started=",
+	"d.timestamp.finished=",
+	"d.session_file=",
+	"t.multicall=,t.url=",
+}
+
+// CustomQuery returns the d.multicall2 command reading a custom field,
+// which is one of the numbered custom1-5 fields or a named d.custom key.
+func CustomQuery(field string) string {
+	if numberedCustomField.MatchString(field) {
+		return "d." + field + "="
+	}
+	return "d.custom=" + field
+}
+
+// Torrents lists the torrents of a view with a single d.multicall2. Each
+// custom field is fetched along with the others.
+func (c *Client) Torrents(view string, custom ...string) ([]Torrent, error) {
+	args := []any{"", view}
+	for _, field := range torrentFields {
+		args = append(args, field)
+	}
+	for _, field := range custom {
+		args = append(args, CustomQuery(field))
+	}
+
+	result, err := c.Call("d.multicall2", args...)
+	if err != nil {
+		return nil, err
+	}
+	rows, ok := result.([]any)
+	if !ok {
+		return nil, errors.Errorf("d.multicall2: unexpected result %v", result)
+	}
+
+	torrents := make([]Torrent, 0, len(rows))
+	for _, row := range rows {
+		values, ok := row.([]any)
+		if !ok || len(values) != len(args)-2 {
+			return nil, errors.Errorf("d.multicall2: unexpected row %v", row)
+		}
+		r := decoder{values: values}
+		t := Torrent{
+			Hash:        r.string(),
+			Name:        r.string(),
+			Label:       r.string(),
+			Directory:   r.string(),
+			Size:        r.int(),
+			Complete:    r.int() != 0,
+			MultiFile:   r.int() != 0,
+			Started:     time.Unix(r.int(), 0),
+			Finished:    time.Unix(r.int(), 0),
+			SessionFile: r.string(),
+			Trackers:    r.column(),
+			Custom:      make(map[string]string, len(custom)),
+		}
+		for _, field := range custom {
+			t.Custom[field] = r.string()
+		}
+		if r.err != nil {
+			return nil, errors.Wrap(r.err, "d.multicall2")
+		}
+		torrents = append(torrents, t)
+	}
+	return torrents, nil
+}
+
+// File is one file of a torrent. Path is relative to the torrent's
+// directory.
+type File struct {
+	Path string
+	Size int64
+}
+
+// Files lists the files of several torrents in a single system.multicall.
+// Torrents rtorrent no longer knows about are left out of the result.
+func (c *Client) Files(hashes ...string) (map[string][]File, error) {
+	calls := make([]MulticallEntry, len(hashes))
+	for idx, hash := range hashes {
+		calls[idx] = MulticallEntry{"f.multicall", []any{hash, "", "f.path=", "f.size_bytes="}}
+	}
+
+	results, err := c.Multicall(calls)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]File, len(hashes))
+	for idx, result := range results {
+		if _, ok := result.(*Fault); ok {
+			continue
+		}
+		rows, err := rowsOf(result)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s %s", calls[idx].Method, hashes[idx])
+		}
+		list := make([]File, 0, len(rows))
+		for _, row := range rows {
+			r := decoder{values: row}
+			f := File{Path: r.string(), Size: r.int()}
+			if r.err != nil {
+				return nil, errors.Wrapf(r.err, "%s %s", calls[idx].Method, hashes[idx])
+			}
+			list = append(list, f)
+		}
+		files[hashes[idx]] = list
+	}
+	return files, nil
+}
+
+// Trackers lists the tracker URLs of several torrents in a single
+// system.multicall. Torrents rtorrent no longer knows about are left out of
+// the result.
+func (c *Client) Trackers(hashes ...string) (map[string][]string, error) {
+	calls := make([]MulticallEntry, len(hashes))
+	for idx, hash := range hashes {
+		calls[idx] = MulticallEntry{"t.multicall", []any{hash, "", "t.url="}}
+	}
+
+	results, err := c.Multicall(calls)
+	if err != nil {
+		return nil, err
+	}
+
+	trackers := make(map[string][]string, len(hashes))
+	for idx, result := range results {
+		if _, ok := result.(*Fault); ok {
+			continue
+		}
+		rows, err := rowsOf(result)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s %s", calls[idx].Method, hashes[idx])
+		}
+		var urls []string
+		for _, row := range rows {
+			r := decoder{values: row}
+			if url := r.string(); r.err == nil {
+				urls = append(urls, url)
+			}
+		}
+		trackers[hashes[idx]] = urls
+	}
+	return trackers, nil
+}
+
+// SetCustom sets a custom field, either one of the numbered custom1-5
+// fields or a named d.custom key.
+func (c *Client) SetCustom(hash, field, value string) error {
+	var err error
+	if numberedCustomField.MatchString(field) {
+		_, err = c.Call(fmt.Sprintf("d.%s.set", field), hash, value)
+	} else {
+		_, err = c.Call("d.custom.set", hash, field, value)
+	}
+	return err
+}
+
+// Custom reads a custom field of one torrent.
+func (c *Client) Custom(hash, field string) (string, error) {
+	if numberedCustomField.MatchString(field) {
+		return c.String("d."+field, hash)
+	}
+	return c.String("d.custom", hash, field)
+}
+
+// SetLabel sets the label ruTorrent and most other frontends show, which
+// is stored in custom1.
+func (c *Client) SetLabel(hash, label string) error {
+	return c.SetCustom(hash, "custom1", label)
+}
+
+func rowsOf(result any) ([][]any, error) {
+	list, ok := result.([]any)
+	if !ok {
+		return nil, errors.Errorf("unexpected result %v", result)
+	}
+	rows := make([][]any, 0, len(list))
+	for _, row := range list {
+		values, ok := row.([]any)
+		if !ok {
+			return nil, errors.Errorf("unexpected row %v", row)
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
+
+// decoder reads the columns of a multicall row in order, remembering the
+// first type mismatch.
+type decoder struct {
+	values []any
+	pos    int
+	err    error
+}
+
+func (d *decoder) next() any {
+	if d.pos >= len(d.values) {
+		if d.err == nil {
+			d.err = errors.Errorf("missing column %d", d.pos)
+		}
+		return nil
+	}
+	v := d.values[d.pos]
+	d.pos++
+	return v
+}
+
+func (d *decoder) string() string {
+	v := d.next()
+	s, ok := v.(string)
+	if !ok && d.err == nil {
+		d.err = errors.Errorf("column %d isn't a string: %v", d.pos-1, v)
+	}
+	return s
+}
+
+// column reads a nested multicall of one string per row.
+func (d *decoder) column() []string {
+	v := d.next()
+	rows, err := rowsOf(v)
+	if err != nil {
+		if d.err == nil {
+			d.err = errors.Wrapf(err, "column %d", d.pos-1)
+		}
+		return nil
+	}
+	values := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if len(row) > 0 {
+			if s, ok := row[0].(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+func (d *decoder) int() int64 {
+	v := d.next()
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int64:
+		return n
+	}
+	if d.err == nil {
+		d.err = errors.Errorf("column %d isn't an integer: %v", d.pos-1, v)
+	}
+	return 0
+}
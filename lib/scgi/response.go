@@ -0,0 +1,123 @@
+package scgi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ErrEmptyResponse is returned when the server closes the connection without
+// sending anything.
+var ErrEmptyResponse = errors.New("scgi: empty response")
+
+// HeaderError describes a malformed CGI response header block.
+type HeaderError struct {
+	Err error
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("scgi: malformed response header: %s", e.Err)
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError describes an invalid Status header.
+type StatusError struct {
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("scgi: invalid status %q", e.Status)
+}
+
+// ReadResponse parses a CGI response as described by RFC 3875. The headers
+// may come in any order. Without a Status header the status is 302 Found if
+// there is a Location header, and 200 OK otherwise.
+func ReadResponse(r *bufio.Reader, req *http.Request) (*http.Response, error) {
+	if _, err := r.Peek(1); err == io.EOF {
+		return nil, ErrEmptyResponse
+	} else if err != nil {
+		return nil, err
+	}
+
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &HeaderError{err}
+	}
+
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header(header),
+		Request:    req,
+	}
+
+	if status := header.Get("Status"); status != "" {
+		resp.StatusCode, resp.Status, err = parseStatus(status)
+		if err != nil {
+			return nil, err
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		resp.StatusCode = http.StatusFound
+	} else {
+		resp.StatusCode = http.StatusOK
+	}
+	if resp.Status == "" {
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	resp.ContentLength = -1
+	if cl := header.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+		if err != nil || n < 0 {
+			return nil, &HeaderError{fmt.Errorf("invalid Content-Length %q", cl)}
+		}
+		resp.ContentLength = n
+	}
+
+	switch {
+	case req != nil && req.Method == http.MethodHead,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified:
+		resp.ContentLength = 0
+		resp.Body = http.NoBody
+	case resp.ContentLength >= 0:
+		resp.Body = io.NopCloser(io.LimitReader(r, resp.ContentLength))
+	default:
+		resp.Body = io.NopCloser(r)
+	}
+
+	return resp, nil
+}
+
+// parseStatus parses the value of a Status header, such as "404 Not Found".
+// The reason phrase is optional.
+func parseStatus(status string) (int, string, error) {
+	status = strings.TrimSpace(status)
+	code, reason, _ := strings.Cut(status, " ")
+	if len(code) != 3 {
+		return 0, "", &StatusError{status}
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil || n < 100 {
+		return 0, "", &StatusError{status}
+	}
+
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = http.StatusText(n)
+	}
+	return n, fmt.Sprintf("%d %s", n, reason), nil
+}
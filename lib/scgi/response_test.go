@@ -0,0 +1,174 @@
+package scgi
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		input         string
+		status        string
+		contentLength int64
+		body          string
+	}{
+		{
+			"no status",
+			http.MethodPost,
+			"Content-Type: text/xml\r\n\r\n<ok/>",
+			"200 OK", -1, "<ok/>",
+		},
+		{
+			"location without status",
+			http.MethodGet,
+			"Location: /elsewhere\r\n\r\n",
+			"302 Found", -1, "",
+		},
+		{
+			"status after other headers",
+			http.MethodPost,
+			"Content-Type: text/plain\r\nStatus: 404 Not Found\r\n\r\nmissing",
+			"404 Not Found", -1, "missing",
+		},
+		{
+			"status without reason",
+			http.MethodPost,
+			"Status: 500\r\n\r\n",
+			"500 Internal Server Error", -1, "",
+		},
+		{
+			"status overrides location",
+			http.MethodGet,
+			"Location: /elsewhere\r\nStatus: 301 Moved\r\n\r\n",
+			"301 Moved", -1, "",
+		},
+		{
+			"content length limits the body",
+			http.MethodPost,
+			"Content-Length: 3\r\n\r\nabcdef",
+			"200 OK", 3, "abc",
+		},
+		{
+			"no content",
+			http.MethodPost,
+			"Status: 204 No Content\r\n\r\nignored",
+			"204 No Content", 0, "",
+		},
+		{
+			"head request",
+			http.MethodHead,
+			"Content-Length: 5\r\n\r\nhello",
+			"200 OK", 0, "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "http://scgi/RPC2", nil)
+			resp, err := ReadResponse(bufio.NewReader(strings.NewReader(tt.input)), req)
+			if err != nil {
+				t.Fatalf("ReadResponse error: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.Status != tt.status {
+				t.Errorf("Status = %q, want %q", resp.Status, tt.status)
+			}
+			if resp.Header.Get("Status") != "" {
+				t.Error("the Status header is left in the response headers")
+			}
+			if resp.ContentLength != tt.contentLength {
+				t.Errorf("ContentLength = %d, want %d", resp.ContentLength, tt.contentLength)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading body: %s", err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestReadResponseErrors(t *testing.T) {
+	var headerErr *HeaderError
+	var statusErr *StatusError
+
+	tests := []struct {
+		name  string
+		input string
+		check func(error) bool
+	}{
+		{"empty response", "", func(err error) bool { return err == ErrEmptyResponse }},
+		{"malformed status", "Status: OK\r\n\r\n", func(err error) bool { return errors.As(err, &statusErr) }},
+		{"short status code", "Status: 20 OK\r\n\r\n", func(err error) bool { return errors.As(err, &statusErr) }},
+		{"status code too low", "Status: 099 Low\r\n\r\n", func(err error) bool { return errors.As(err, &statusErr) }},
+		{"bad content length", "Content-Length: ten\r\n\r\n", func(err error) bool { return errors.As(err, &headerErr) }},
+		{"negative content length", "Content-Length: -1\r\n\r\n", func(err error) bool { return errors.As(err, &headerErr) }},
+		{"malformed header line", "not a header\r\n\r\n", func(err error) bool { return errors.As(err, &headerErr) }},
+		{
+			"truncated headers",
+			"Content-Type: text/xml\r\n",
+			func(err error) bool { return errors.As(err, &headerErr) && errors.Is(err, io.ErrUnexpectedEOF) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ReadResponse(bufio.NewReader(strings.NewReader(tt.input)), nil)
+			if err == nil {
+				t.Fatalf("ReadResponse = %s, want error", resp.Status)
+			}
+			if !tt.check(err) {
+				t.Errorf("ReadResponse error %T %q is not the expected kind", err, err)
+			}
+		})
+	}
+}
+
+func FuzzReadResponse(f *testing.F) {
+	f.Add("Content-Type: text/xml\r\n\r\n<ok/>")
+	f.Add("Status: 404 Not Found\r\nContent-Length: 3\r\n\r\nabcdef")
+	f.Add("Location: /elsewhere\r\n\r\n")
+	f.Add("Status: 204\r\n\r\n")
+	f.Add("Content-Length: ten\r\n\r\n")
+	f.Add("Status: \r\n\r\n")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		resp, err := ReadResponse(bufio.NewReader(strings.NewReader(input)), nil)
+		if err != nil {
+			if resp != nil {
+				t.Fatal("ReadResponse returned a response with an error")
+			}
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 100 || resp.StatusCode > 999 {
+			t.Errorf("StatusCode %d out of range", resp.StatusCode)
+		}
+		if !strings.HasPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" ") {
+			t.Errorf("Status %q does not start with the code", resp.Status)
+		}
+		if resp.ContentLength < -1 {
+			t.Errorf("ContentLength = %d", resp.ContentLength)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("reading body: %s", err)
+		}
+		if resp.ContentLength >= 0 && int64(len(body)) > resp.ContentLength {
+			t.Errorf("read %d bytes, more than ContentLength %d", len(body), resp.ContentLength)
+		}
+	})
+}
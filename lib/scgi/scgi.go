@@ -0,0 +1,129 @@
+// Package scgi implements the client side of the SCGI protocol as an
+// http.RoundTripper.
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Transport sends each request over a new connection returned by Dial.
+type Transport struct {
+	Dial func() (net.Conn, error)
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "scgi: failed to read request body")
+	}
+
+	conn, err := t.Dial()
+	if err != nil {
+		return nil, errors.Wrap(err, "scgi: dial error")
+	}
+	if deadline, ok := req.Context().Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := WriteRequest(conn, req, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the server ends the response by closing the connection, so it is
+	// only closed here once the caller is done with the body
+	resp.Body = &connBody{resp.Body, conn}
+	return resp, nil
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	return io.ReadAll(req.Body)
+}
+
+// WriteRequest writes the SCGI header block for req followed by body.
+func WriteRequest(w io.Writer, req *http.Request, body []byte) error {
+	var headers bytes.Buffer
+	header := func(key, value string) {
+		headers.WriteString(key)
+		headers.WriteByte(0)
+		headers.WriteString(value)
+		headers.WriteByte(0)
+	}
+
+	// CONTENT_LENGTH must come first
+	header("CONTENT_LENGTH", strconv.Itoa(len(body)))
+	header("SCGI", "1")
+	header("REQUEST_METHOD", req.Method)
+	header("SERVER_PROTOCOL", req.Proto)
+	if req.URL != nil {
+		header("REQUEST_URI", req.URL.RequestURI())
+	}
+
+	for key, values := range req.Header {
+		name := cgiHeaderName(key)
+		if name == "" {
+			continue
+		}
+		header(name, strings.Join(values, ","))
+	}
+
+	if err := writeNetstring(w, headers.Bytes()); err != nil {
+		return errors.Wrap(err, "scgi: header write error")
+	}
+	if _, err := w.Write(body); err != nil {
+		return errors.Wrap(err, "scgi: body write error")
+	}
+	return nil
+}
+
+// cgiHeaderName maps an HTTP header to its CGI meta-variable, or "" for
+// headers that must not be repeated.
+func cgiHeaderName(key string) string {
+	name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+	switch name {
+	case "CONTENT_LENGTH":
+		return ""
+	case "CONTENT_TYPE":
+		return name
+	default:
+		return "HTTP_" + name
+	}
+}
+
+func writeNetstring(w io.Writer, data []byte) error {
+	buf := make([]byte, 0, len(data)+12)
+	buf = strconv.AppendInt(buf, int64(len(data)), 10)
+	buf = append(buf, ':')
+	buf = append(buf, data...)
+	buf = append(buf, ',')
+	_, err := w.Write(buf)
+	return err
+}
+
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
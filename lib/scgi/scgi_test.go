@@ -0,0 +1,203 @@
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scgiRequest is a request as read by the test server.
+type scgiRequest struct {
+	// header names in the order they were sent
+	names   []string
+	headers map[string]string
+	body    string
+}
+
+// readRequest reads an SCGI request: a netstring of NUL separated header
+// names and values, followed by CONTENT_LENGTH bytes of body.
+func readRequest(r *bufio.Reader) (*scgiRequest, error) {
+	size, err := r.ReadString(':')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(size, ":"))
+	if err != nil {
+		return nil, fmt.Errorf("bad netstring length %q", size)
+	}
+	block := make([]byte, n+1)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, err
+	}
+	if block[n] != ',' {
+		return nil, fmt.Errorf("netstring does not end with a comma")
+	}
+
+	fields := bytes.Split(block[:n], []byte{0})
+	if len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+		return nil, fmt.Errorf("header block is not NUL terminated pairs: %q", block[:n])
+	}
+	req := &scgiRequest{headers: make(map[string]string)}
+	for idx := 0; idx+1 < len(fields); idx += 2 {
+		name := string(fields[idx])
+		req.names = append(req.names, name)
+		req.headers[name] = string(fields[idx+1])
+	}
+
+	length, err := strconv.Atoi(req.headers["CONTENT_LENGTH"])
+	if err != nil {
+		return nil, fmt.Errorf("bad CONTENT_LENGTH %q", req.headers["CONTENT_LENGTH"])
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	req.body = string(body)
+	return req, nil
+}
+
+// serveSCGI answers one request on l with response, and reports the
+// request it read on requests.
+func serveSCGI(t *testing.T, l net.Listener, response string, requests chan<- *scgiRequest) {
+	defer close(requests)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Errorf("accept: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	req, err := readRequest(bufio.NewReader(conn))
+	if err != nil {
+		t.Errorf("reading scgi request: %s", err)
+		return
+	}
+	requests <- req
+
+	io.WriteString(conn, response)
+}
+
+func TestTransportRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		network  string
+		response string
+		status   int
+		body     string
+	}{
+		{
+			"tcp",
+			"tcp",
+			"Status: 200 OK\r\nContent-Type: text/xml\r\n\r\n<methodResponse/>",
+			http.StatusOK, "<methodResponse/>",
+		},
+		{
+			"unix",
+			"unix",
+			"Content-Type: text/xml\r\nContent-Length: 17\r\n\r\n<methodResponse/>trailing",
+			http.StatusOK, "<methodResponse/>",
+		},
+		{
+			"error status",
+			"tcp",
+			"Status: 500 Internal Server Error\r\n\r\nfailed",
+			http.StatusInternalServerError, "failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := "127.0.0.1:0"
+			if tt.network == "unix" {
+				addr = t.TempDir() + "/rpc.socket"
+			}
+			l, err := net.Listen(tt.network, addr)
+			if err != nil {
+				t.Fatalf("listen: %s", err)
+			}
+			defer l.Close()
+
+			requests := make(chan *scgiRequest, 1)
+			go serveSCGI(t, l, tt.response, requests)
+
+			client := &http.Client{Transport: &Transport{
+				Dial: func() (net.Conn, error) {
+					return net.Dial(tt.network, l.Addr().String())
+				},
+			}}
+			const payload = "<methodCall><methodName>system.listMethods</methodName></methodCall>"
+			req, err := http.NewRequest(http.MethodPost, "http://scgi/RPC2?q=1", strings.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "text/xml")
+			req.Header.Set("X-Request-Id", "abc")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("round trip: %s", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("reading body: %s", err)
+			}
+			if resp.StatusCode != tt.status || string(body) != tt.body {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, tt.status, tt.body)
+			}
+
+			got, ok := <-requests
+			if !ok {
+				t.FailNow()
+			}
+			if len(got.names) == 0 || got.names[0] != "CONTENT_LENGTH" {
+				t.Errorf("headers %v do not start with CONTENT_LENGTH", got.names)
+			}
+			want := map[string]string{
+				"CONTENT_LENGTH":    strconv.Itoa(len(payload)),
+				"SCGI":              "1",
+				"REQUEST_METHOD":    http.MethodPost,
+				"REQUEST_URI":       "/RPC2?q=1",
+				"CONTENT_TYPE":      "text/xml",
+				"HTTP_X_REQUEST_ID": "abc",
+			}
+			for name, value := range want {
+				if got.headers[name] != value {
+					t.Errorf("header %s = %q, want %q", name, got.headers[name], value)
+				}
+			}
+			if got.body != payload {
+				t.Errorf("server read body %q, want %q", got.body, payload)
+			}
+		})
+	}
+}
+
+func TestTransportEmptyResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	requests := make(chan *scgiRequest, 1)
+	go serveSCGI(t, l, "", requests)
+
+	transport := &Transport{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("tcp", l.Addr().String())
+		},
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://scgi/RPC2", strings.NewReader("x"))
+	if resp, err := transport.RoundTrip(req); err != ErrEmptyResponse {
+		t.Errorf("RoundTrip = %v, %v, want %v", resp, err, ErrEmptyResponse)
+	}
+	<-requests
+}
@@ -0,0 +1,154 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	filesBucket    = []byte("files")
+	torrentsBucket = []byte("torrents")
+)
+
+// Hash values recorded for a file, describing how it was last checked.
+const (
+	HashNone   = ""
+	HashPieces = "sha1-pieces"
+	HashMd5    = "md5"
+)
+
+// File is the recorded state of one synced file.
+type File struct {
+	Size        uint64    `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+	Hash        string    `json:"hash,omitempty"`
+	Transferred int64     `json:"transferred"`
+	SyncedAt    time.Time `json:"synced_at"`
+}
+
+// Matches reports whether a local file still looks like it did when it was
+// recorded.
+func (f *File) Matches(size uint64, modTime time.Time) bool {
+	return f.Size == size && f.ModTime.Equal(modTime)
+}
+
+// Torrent is the recorded state of a torrent whose files have all synced.
+type Torrent struct {
+	Name     string    `json:"name"`
+	SyncedAt time.Time `json:"synced_at"`
+
+	// the total size and newest modification time of a mirrored directory
+	// entry, used to notice when it changes after being synced
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime,omitempty"`
+}
+
+// Store is an embedded database of sync state keyed by torrent info-hash and
+// file path.
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "state: failed to open %s", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, torrentsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "state: failed to initialize")
+	}
+
+	return &Store{db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// File returns the recorded state of a file, or nil if there is none.
+func (s *Store) File(infoHash, path string) (*File, error) {
+	var file *File
+	err := s.db.View(func(tx *bolt.Tx) error {
+		torrent := tx.Bucket(filesBucket).Bucket([]byte(infoHash))
+		if torrent == nil {
+			return nil
+		}
+
+		data := torrent.Get([]byte(path))
+		if data == nil {
+			return nil
+		}
+
+		file = new(File)
+		return json.Unmarshal(data, file)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "state: failed to read %s/%s", infoHash, path)
+	}
+	return file, nil
+}
+
+func (s *Store) PutFile(infoHash, path string, file File) error {
+	data, err := json.Marshal(&file)
+	if err != nil {
+		return errors.Wrap(err, "state: failed to encode file")
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		torrent, err := tx.Bucket(filesBucket).CreateBucketIfNotExists([]byte(infoHash))
+		if err != nil {
+			return err
+		}
+		return torrent.Put([]byte(path), data)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "state: failed to write %s/%s", infoHash, path)
+	}
+	return nil
+}
+
+// Torrent returns the recorded state of a torrent, or nil if there is none.
+func (s *Store) Torrent(infoHash string) (*Torrent, error) {
+	var torrent *Torrent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(torrentsBucket).Get([]byte(infoHash))
+		if data == nil {
+			return nil
+		}
+
+		torrent = new(Torrent)
+		return json.Unmarshal(data, torrent)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "state: failed to read %s", infoHash)
+	}
+	return torrent, nil
+}
+
+func (s *Store) PutTorrent(infoHash string, torrent Torrent) error {
+	data, err := json.Marshal(&torrent)
+	if err != nil {
+		return errors.Wrap(err, "state: failed to encode torrent")
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(torrentsBucket).Put([]byte(infoHash), data)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "state: failed to write %s", infoHash)
+	}
+	return nil
+}
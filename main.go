@@ -3,51 +3,95 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"sort"
 	"sync"
-
-	"github.com/mrobinsn/go-rtorrent/rtorrent"
 )
 
 func main() {
 	flag.Parse()
 
 	shared := NewSharedUnit("config.toml")
-	defer shared.Close()
+	defer func() {
+		shared.Close()
+		// exit with a distinct status if a signal interrupted the run
+		if code := shared.exitCode.Load(); code != 0 {
+			os.Exit(int(code))
+		}
+	}()
+
+	if *flagDaemon {
+		runDaemon(shared)
+		return
+	}
 
+	if _, err := syncTorrents(shared, nil); err != nil && shared.stopCtx.Err() == nil {
+		shared.log.FATAL.Panicf("Error getting torrents: %s", err)
+	}
+}
+
+// syncTorrents fetches the torrents from rtorrent and runs every one accepted
+// by filter through the torrent handler, waiting until all are processed. A
+// nil filter accepts every torrent. The returned hashes are the torrents that
+// are now marked as synced.
+func syncTorrents(shared *sharedUnit, filter func(torrentInfo) bool) ([]string, error) {
 	shared.log.INFO.Println("Getting torrents...")
-	torrents, err := shared.rtorrentClient.GetTorrents(rtorrent.ViewMain)
+	var torrents []torrentInfo
+	err := shared.config.Retry.Client.do(shared.stopCtx, shared.log, func() (err error) {
+		torrents, err = shared.client.Torrents()
+		return err
+	})
 	if err != nil {
-		shared.log.FATAL.Panicf("Error getting torrents: %s", err)
+		return nil, err
 	}
 
 	shared.log.INFO.Printf("Fetched %d torrents", len(torrents))
 
+	if filter != nil {
+		filtered := torrents[:0]
+		for _, torrent := range torrents {
+			if filter(torrent) {
+				filtered = append(filtered, torrent)
+			}
+		}
+		torrents = filtered
+		shared.log.INFO.Printf("Processing %d torrents", len(torrents))
+	}
+
 	sort.Slice(torrents, func(i, j int) bool {
 		a := torrents[i].Finished
 		b := torrents[j].Finished
 		return a.Before(b)
 	})
 
+	var mu sync.Mutex
+	var synced []string
 	var wg sync.WaitGroup
 	wg.Add(len(torrents))
 	for idx, torrent := range torrents {
 		name := fmt.Sprintf("Torrent %s", torrent.Name)
-		shared.torrentHandler.Send(&torrentUnit{
+		unit := &torrentUnit{
 			shared:  shared,
 			log:     shared.NewNotepad(name),
 			name:    name,
 			torrent: torrent,
 			index:   idx,
-			callback: func(err error) {
-				if err != nil {
-					shared.log.ERROR.Printf("Error processing torrent %s: %s", name, err)
-				}
-				wg.Done()
-			},
-		})
+		}
+		unit.callback = func(err error) {
+			if err != nil {
+				shared.log.ERROR.Printf("Error processing torrent %s: %s", name, err)
+			} else if unit.synced {
+				mu.Lock()
+				synced = append(synced, unit.torrent.Hash)
+				mu.Unlock()
+			}
+			wg.Done()
+		}
+		shared.torrentHandler.Send(unit)
 	}
 	wg.Wait()
+
+	return synced, nil
 }
 
 func max(a, b int) int {
@@ -56,3 +100,17 @@ func max(a, b int) int {
 	}
 	return a
 }
+
+func max64(a, b int64) int64 {
+	if a < b {
+		return b
+	}
+	return a
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
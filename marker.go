@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/rtorrent"
+	"github.com/demosdemon/seedbox-sync/lib/state"
+	"github.com/pkg/errors"
+)
+
+const (
+	markerLabel    = "label"
+	markerCustom   = "custom"
+	markerState    = "state"
+	markerTag      = "tag"
+	markerCategory = "category"
+)
+
+// syncMarker records which torrents have been completely synced.
+type syncMarker interface {
+	IsSynced(torrent torrentInfo) (bool, error)
+	MarkSynced(torrent torrentInfo) error
+}
+
+func (c *Config) SyncMarker(client *rtorrentClient, store *state.Store) syncMarker {
+	cfg := c.Remote.Rtorrent
+	switch cfg.SyncMarker {
+	case markerLabel:
+		return labelMarker{client.rt, cfg.SyncTag}
+	case markerState:
+		return stateMarker{store}
+	default:
+		return customFieldMarker{client, cfg.SyncField, cfg.SyncTag}
+	}
+}
+
+// labelMarker overwrites the rtorrent label with the sync tag.
+type labelMarker struct {
+	client *rtorrent.Client
+	tag    string
+}
+
+func (m labelMarker) IsSynced(torrent torrentInfo) (bool, error) {
+	return torrent.Label == m.tag, nil
+}
+
+func (m labelMarker) MarkSynced(torrent torrentInfo) error {
+	return m.client.SetLabel(torrent.Hash, m.tag)
+}
+
+// customFieldMarker stores the sync time in an rtorrent custom field.
+type customFieldMarker struct {
+	client *rtorrentClient
+	field  string
+	// torrents labeled by older versions are still treated as synced
+	legacyTag string
+}
+
+func (m customFieldMarker) IsSynced(torrent torrentInfo) (bool, error) {
+	if torrent.Label == m.legacyTag {
+		return true, nil
+	}
+
+	value, err := m.client.custom(torrent.Hash)
+	if err != nil {
+		return false, err
+	}
+
+	return value != "", nil
+}
+
+func (m customFieldMarker) MarkSynced(torrent torrentInfo) error {
+	value := time.Now().UTC().Format(time.RFC3339)
+	err := m.client.rt.SetCustom(torrent.Hash, m.field, value)
+	return errors.Wrapf(err, "failed to set %s", m.field)
+}
+
+// stateMarker only records synced torrents in the local state database.
+type stateMarker struct {
+	store *state.Store
+}
+
+func (m stateMarker) IsSynced(torrent torrentInfo) (bool, error) {
+	record, err := m.store.Torrent(torrent.Hash)
+	return record != nil, err
+}
+
+func (m stateMarker) MarkSynced(torrent torrentInfo) error {
+	return m.store.PutTorrent(torrent.Hash, state.Torrent{
+		Name:     torrent.Name,
+		SyncedAt: time.Now(),
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha1"
+	"io"
+	"strings"
+
+	"github.com/demosdemon/seedbox-sync/lib/bencode"
+	"github.com/pkg/errors"
+)
+
+const kMaxMetainfoSize = 64 << 20
+
+// metainfo is the subset of a .torrent file needed to verify local data
+// against the torrent's own piece hashes.
+type metainfo struct {
+	name        string
+	pieceLength int64
+	totalLength int64
+	pieces      [][sha1.Size]byte
+	files       []metainfoFile
+	byPath      map[string]int
+	// whether the files are under a root folder named after the torrent
+	multiFile bool
+}
+
+type metainfoFile struct {
+	// path relative to the torrent root, joined with "/" the same way
+	// rtorrent reports f.path
+	path    string
+	offset  int64
+	length  int64
+	padding bool
+}
+
+// byteRange is a half-open [start, end) range of bytes.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func parseMetainfo(data []byte) (*metainfo, error) {
+	root, err := bencode.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := root.(map[string]any)
+	if !ok {
+		return nil, errors.New("metainfo: not a dictionary")
+	}
+
+	info, ok := dict["info"].(map[string]any)
+	if !ok {
+		return nil, errors.New("metainfo: missing info dictionary")
+	}
+
+	var mi metainfo
+	mi.byPath = make(map[string]int)
+
+	if mi.name, ok = info["name"].(string); !ok {
+		return nil, errors.New("metainfo: missing info.name")
+	}
+
+	if mi.pieceLength, ok = info["piece length"].(int64); !ok || mi.pieceLength <= 0 {
+		return nil, errors.New("metainfo: missing or invalid info.piece length")
+	}
+
+	pieces, ok := info["pieces"].(string)
+	if !ok {
+		// v2-only torrents have no sha1 piece list
+		return nil, errors.New("metainfo: missing info.pieces")
+	}
+	if len(pieces)%sha1.Size != 0 {
+		return nil, errors.Errorf("metainfo: info.pieces length %d is not a multiple of %d", len(pieces), sha1.Size)
+	}
+	mi.pieces = make([][sha1.Size]byte, len(pieces)/sha1.Size)
+	for idx := range mi.pieces {
+		copy(mi.pieces[idx][:], pieces[idx*sha1.Size:])
+	}
+
+	if length, ok := info["length"].(int64); ok {
+		mi.addFile(mi.name, length, false)
+	} else if files, ok := info["files"].([]any); ok {
+		mi.multiFile = true
+		for idx, file := range files {
+			if err := mi.addFileEntry(file); err != nil {
+				return nil, errors.Wrapf(err, "metainfo: info.files[%d]", idx)
+			}
+		}
+	} else {
+		return nil, errors.New("metainfo: missing info.length and info.files")
+	}
+
+	expected := (mi.totalLength + mi.pieceLength - 1) / mi.pieceLength
+	if int64(len(mi.pieces)) != expected {
+		return nil, errors.Errorf("metainfo: expected %d pieces, found %d", expected, len(mi.pieces))
+	}
+
+	return &mi, nil
+}
+
+func (mi *metainfo) addFileEntry(v any) error {
+	file, ok := v.(map[string]any)
+	if !ok {
+		return errors.New("not a dictionary")
+	}
+
+	length, ok := file["length"].(int64)
+	if !ok || length < 0 {
+		return errors.New("missing or invalid length")
+	}
+
+	elems, ok := file["path"].([]any)
+	if !ok || len(elems) == 0 {
+		return errors.New("missing or invalid path")
+	}
+
+	parts := make([]string, len(elems))
+	for idx, elem := range elems {
+		if parts[idx], ok = elem.(string); !ok {
+			return errors.New("invalid path element")
+		}
+	}
+
+	attr, _ := file["attr"].(string)
+	mi.addFile(strings.Join(parts, "/"), length, strings.ContainsRune(attr, 'p'))
+	return nil
+}
+
+func (mi *metainfo) addFile(path string, length int64, padding bool) {
+	mi.byPath[path] = len(mi.files)
+	mi.files = append(mi.files, metainfoFile{
+		path:    path,
+		offset:  mi.totalLength,
+		length:  length,
+		padding: padding,
+	})
+	mi.totalLength += length
+}
+
+func (mi *metainfo) file(path string) (metainfoFile, bool) {
+	idx, ok := mi.byPath[path]
+	if !ok {
+		return metainfoFile{}, false
+	}
+	return mi.files[idx], true
+}
+
+// pieceBounds returns the range of the torrent's byte stream covered by a piece.
+func (mi *metainfo) pieceBounds(piece int) byteRange {
+	start := int64(piece) * mi.pieceLength
+	end := start + mi.pieceLength
+	if end > mi.totalLength {
+		end = mi.totalLength
+	}
+	return byteRange{start, end}
+}
+
+// pieceSpan returns the first and last piece that overlap the file. The
+// result is empty (first > last) for zero-length files.
+func (mi *metainfo) pieceSpan(file metainfoFile) (int, int) {
+	if file.length == 0 {
+		return 0, -1
+	}
+	first := file.offset / mi.pieceLength
+	last := (file.offset + file.length - 1) / mi.pieceLength
+	return int(first), int(last)
+}
+
+// overlapping calls fn for every file with bytes inside r, along with the
+// overlapping range relative to the start of that file.
+func (mi *metainfo) overlapping(r byteRange, fn func(metainfoFile, byteRange) error) error {
+	for _, file := range mi.files {
+		start := max64(r.start, file.offset)
+		end := min64(r.end, file.offset+file.length)
+		if start >= end {
+			continue
+		}
+		if err := fn(file, byteRange{start - file.offset, end - file.offset}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMetainfo(r io.Reader) (*metainfo, error) {
+	data, err := io.ReadAll(io.LimitReader(r, kMaxMetainfoSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "metainfo: read error")
+	}
+	if len(data) > kMaxMetainfoSize {
+		return nil, errors.Errorf("metainfo: larger than %d bytes", kMaxMetainfoSize)
+	}
+	return parseMetainfo(data)
+}
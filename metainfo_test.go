@@ -0,0 +1,187 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// piece boundaries at 16, 32 and 48 in a 64 byte stream:
+//
+//	file0 [0, 10)  file1 [10, 60)  file2 [60, 60)  file3 [60, 64)
+var multiFileTorrent = "d4:infod5:filesl" +
+	"d6:lengthi10e4:pathl3:dir5:file0ee" +
+	"d6:lengthi50e4:pathl3:dir5:file1ee" +
+	"d6:lengthi0e4:pathl3:dir5:file2ee" +
+	"d6:lengthi4e4:pathl3:dir5:file3ee" +
+	"e4:name5:multi12:piece lengthi16e6:pieces80:" + strings.Repeat("x", 80) + "ee"
+
+func TestParseMetainfoSingleFile(t *testing.T) {
+	input := "d4:infod6:lengthi100e4:name10:single.bin12:piece lengthi32e6:pieces80:" + strings.Repeat("x", 80) + "ee"
+	mi, err := parseMetainfo([]byte(input))
+	if err != nil {
+		t.Fatalf("parseMetainfo: %s", err)
+	}
+
+	file, ok := mi.file("single.bin")
+	if !ok {
+		t.Fatal("single.bin not found")
+	}
+	if file.offset != 0 || file.length != 100 {
+		t.Errorf("file = %+v, want offset 0 length 100", file)
+	}
+	if mi.multiFile {
+		t.Error("a torrent with info.length is multi-file")
+	}
+
+	if first, last := mi.pieceSpan(file); first != 0 || last != 3 {
+		t.Errorf("pieceSpan = %d-%d, want 0-3", first, last)
+	}
+
+	// the last piece is short
+	if got, want := mi.pieceBounds(3), (byteRange{96, 100}); got != want {
+		t.Errorf("pieceBounds(3) = %+v, want %+v", got, want)
+	}
+	if got, want := mi.pieceBounds(0), (byteRange{0, 32}); got != want {
+		t.Errorf("pieceBounds(0) = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseMetainfoMultiFile(t *testing.T) {
+	mi, err := parseMetainfo([]byte(multiFileTorrent))
+	if err != nil {
+		t.Fatalf("parseMetainfo: %s", err)
+	}
+	if !mi.multiFile {
+		t.Error("a torrent with info.files is not multi-file")
+	}
+
+	tests := []struct {
+		path   string
+		offset int64
+		length int64
+		first  int
+		last   int
+	}{
+		{"dir/file0", 0, 10, 0, 0},
+		{"dir/file1", 10, 50, 0, 3},
+		{"dir/file2", 60, 0, 0, -1},
+		{"dir/file3", 60, 4, 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			file, ok := mi.file(tt.path)
+			if !ok {
+				t.Fatalf("%s not found", tt.path)
+			}
+			if file.offset != tt.offset || file.length != tt.length {
+				t.Errorf("file = %+v, want offset %d length %d", file, tt.offset, tt.length)
+			}
+			if first, last := mi.pieceSpan(file); first != tt.first || last != tt.last {
+				t.Errorf("pieceSpan = %d-%d, want %d-%d", first, last, tt.first, tt.last)
+			}
+		})
+	}
+
+	if _, ok := mi.file("file0"); ok {
+		t.Error("files are looked up by their path below the torrent root")
+	}
+}
+
+func TestMetainfoOverlapping(t *testing.T) {
+	mi, err := parseMetainfo([]byte(multiFileTorrent))
+	if err != nil {
+		t.Fatalf("parseMetainfo: %s", err)
+	}
+
+	type overlap struct {
+		path string
+		rel  byteRange
+	}
+
+	tests := []struct {
+		name string
+		r    byteRange
+		want []overlap
+	}{
+		{
+			"first piece spans two files",
+			mi.pieceBounds(0),
+			[]overlap{{"dir/file0", byteRange{0, 10}}, {"dir/file1", byteRange{0, 6}}},
+		},
+		{
+			"middle piece inside one file",
+			mi.pieceBounds(1),
+			[]overlap{{"dir/file1", byteRange{6, 22}}},
+		},
+		{
+			"last piece skips the empty file",
+			mi.pieceBounds(3),
+			[]overlap{{"dir/file1", byteRange{38, 50}}, {"dir/file3", byteRange{0, 4}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []overlap
+			err := mi.overlapping(tt.r, func(file metainfoFile, rel byteRange) error {
+				got = append(got, overlap{file.path, rel})
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("overlapping: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("overlapping(%+v) = %+v, want %+v", tt.r, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMetainfoPadding(t *testing.T) {
+	input := "d4:infod5:filesl" +
+		"d6:lengthi10e4:pathl3:dir5:file0ee" +
+		"d4:attr1:p6:lengthi6e4:pathl3:dir5:file1ee" +
+		"d6:lengthi16e4:pathl3:dir5:file2ee" +
+		"e4:name5:multi12:piece lengthi16e6:pieces40:" + strings.Repeat("x", 40) + "ee"
+	mi, err := parseMetainfo([]byte(input))
+	if err != nil {
+		t.Fatalf("parseMetainfo: %s", err)
+	}
+	pad, _ := mi.file("dir/file1")
+	if !pad.padding {
+		t.Error("file1 is not marked as padding")
+	}
+	last, _ := mi.file("dir/file2")
+	if first, end := mi.pieceSpan(last); first != 1 || end != 1 {
+		t.Errorf("pieceSpan after padding = %d-%d, want 1-1", first, end)
+	}
+}
+
+func TestParseMetainfoInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"not bencode", "not a torrent"},
+		{"truncated", multiFileTorrent[:40]},
+		{"not a dictionary", "le"},
+		{"missing info", "d8:announce1:xe"},
+		{"missing pieces", "d4:infod6:lengthi10e4:name1:x12:piece lengthi16eee"},
+		{"wrong piece count", "d4:infod6:lengthi40e4:name1:x12:piece lengthi16e6:pieces40:" + strings.Repeat("x", 40) + "ee"},
+		{"ragged pieces", "d4:infod6:lengthi10e4:name1:x12:piece lengthi16e6:pieces5:shortee"},
+		{"zero piece length", "d4:infod6:lengthi10e4:name1:x12:piece lengthi0e6:pieces20:" + strings.Repeat("x", 20) + "ee"},
+		{"missing length and files", "d4:infod4:name1:x12:piece lengthi16e6:pieces20:" + strings.Repeat("x", 20) + "ee"},
+		{"file without path", "d4:infod5:filesld6:lengthi10eee4:name1:x12:piece lengthi16e6:pieces20:" + strings.Repeat("x", 20) + "ee"},
+		{"negative file length", "d4:infod5:filesld6:lengthi-1e4:pathl1:aeee4:name1:x12:piece lengthi16e6:pieces20:" + strings.Repeat("x", 20) + "ee"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if mi, err := parseMetainfo([]byte(tt.input)); err == nil {
+				t.Errorf("parseMetainfo = %+v, want error", mi)
+			}
+		})
+	}
+}
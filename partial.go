@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	partialSuffix      = ".partial"
+	partialStateSuffix = ".partial.json"
+
+	// how many bytes are written between progress checkpoints
+	kCheckpointInterval = 64 << 20
+)
+
+// partialState is the sidecar record of a download in progress. It is only
+// trusted if the remote file still looks the same as when it was written.
+type partialState struct {
+	Remote   string           `json:"remote"`
+	Size     uint64           `json:"size"`
+	ModTime  time.Time        `json:"mtime"`
+	Segments []partialSegment `json:"segments"`
+}
+
+// partialSegment is a [Start, End) range of the file of which the first Done
+// bytes have been written and synced.
+type partialSegment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+func (seg *partialSegment) remaining() int64 {
+	return seg.End - seg.Start - seg.Done
+}
+
+func (state *partialState) matches(remote fileMetadata) bool {
+	return state.Remote == remote.path &&
+		state.Size == remote.size &&
+		state.ModTime.Equal(remote.modTime)
+}
+
+func (state *partialState) done() int64 {
+	var done int64
+	for _, seg := range state.Segments {
+		done += seg.Done
+	}
+	return done
+}
+
+func splitSegments(size int64, count int) []partialSegment {
+	if count < 1 {
+		count = 1
+	}
+	if int64(count) > size {
+		count = max(int(size), 1)
+	}
+
+	segments := make([]partialSegment, count)
+	step := size / int64(count)
+	for idx := range segments {
+		segments[idx].Start = int64(idx) * step
+		segments[idx].End = segments[idx].Start + step
+	}
+	segments[count-1].End = size
+	return segments
+}
+
+// partialFile is a download in progress, written in segments and checkpointed.
+type partialFile struct {
+	log       logging.Notepad
+	file      *os.File
+	path      string
+	statePath string
+	finalPath string
+
+	mu         sync.Mutex
+	state      partialState
+	checkpoint int64
+
+	// serializes writers of the state file
+	checkpointMu sync.Mutex
+}
+
+func openPartialFile(log logging.Notepad, local, remote fileMetadata, segments int) (*partialFile, error) {
+	p := &partialFile{
+		log:       log,
+		path:      local.path + partialSuffix,
+		statePath: local.path + partialStateSuffix,
+		finalPath: local.path,
+	}
+
+	file, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open partial file")
+	}
+	p.file = file
+
+	state, err := p.loadState()
+	if err != nil {
+		log.WARN.Printf("ignoring unreadable partial state %q: %s", p.statePath, err)
+		state = nil
+	} else if state != nil && !state.matches(remote) {
+		log.INFO.Printf("remote file changed since partial download began, starting over")
+		state = nil
+	}
+
+	if state != nil && len(state.Segments) == 0 {
+		log.WARN.Printf("partial state %q has no segments, starting over", p.statePath)
+		state = nil
+	}
+
+	if state != nil {
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "failed to stat partial file")
+		}
+		for _, seg := range state.Segments {
+			if seg.Start+seg.Done > stat.Size() {
+				log.WARN.Printf("partial file is shorter than its checkpoint, starting over")
+				state = nil
+				break
+			}
+		}
+	}
+
+	if state == nil {
+		state = &partialState{
+			Remote:   remote.path,
+			Size:     remote.size,
+			ModTime:  remote.modTime,
+			Segments: splitSegments(int64(remote.size), segments),
+		}
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "failed to truncate partial file")
+		}
+	}
+
+	if err := file.Truncate(int64(remote.size)); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to preallocate partial file")
+	}
+
+	p.state = *state
+	p.checkpoint = p.state.done()
+
+	return p, nil
+}
+
+func (p *partialFile) loadState() (*partialState, error) {
+	data, err := os.ReadFile(p.statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state partialState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Done returns the number of bytes already present in the partial file.
+func (p *partialFile) Done() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state.done()
+}
+
+// Segments returns a copy of the segment layout and progress.
+func (p *partialFile) Segments() []partialSegment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]partialSegment(nil), p.state.Segments...)
+}
+
+// SegmentWriter returns a writer that appends to the given segment.
+func (p *partialFile) SegmentWriter(idx int) *segmentWriter {
+	return &segmentWriter{p, idx}
+}
+
+type segmentWriter struct {
+	p   *partialFile
+	idx int
+}
+
+func (w *segmentWriter) Write(b []byte) (int, error) {
+	p := w.p
+
+	p.mu.Lock()
+	seg := p.state.Segments[w.idx]
+	p.mu.Unlock()
+
+	if int64(len(b)) > seg.remaining() {
+		return 0, errors.Errorf("write past end of segment %d", w.idx)
+	}
+
+	n, err := p.file.WriteAt(b, seg.Start+seg.Done)
+
+	p.mu.Lock()
+	p.state.Segments[w.idx].Done += int64(n)
+	due := p.state.done()-p.checkpoint >= kCheckpointInterval
+	p.mu.Unlock()
+
+	if err != nil {
+		return n, err
+	}
+
+	if due {
+		if err := p.Checkpoint(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Checkpoint flushes the partial file to disk and then records the progress.
+// The order matters: the state must never claim bytes that are not on disk.
+func (p *partialFile) Checkpoint() error {
+	p.checkpointMu.Lock()
+	defer p.checkpointMu.Unlock()
+
+	p.mu.Lock()
+	state := p.state
+	state.Segments = append([]partialSegment(nil), p.state.Segments...)
+	p.mu.Unlock()
+
+	if err := p.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync partial file")
+	}
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode partial state")
+	}
+
+	tmp := p.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write partial state")
+	}
+	if err := os.Rename(tmp, p.statePath); err != nil {
+		return errors.Wrap(err, "failed to replace partial state")
+	}
+
+	p.mu.Lock()
+	if done := state.done(); done > p.checkpoint {
+		p.checkpoint = done
+	}
+	p.mu.Unlock()
+
+	p.log.TRACE.Printf("checkpoint at %d bytes", state.done())
+	return nil
+}
+
+// Commit verifies the partial file is complete and passes check, if given,
+// and renames it into place. A partial file that fails check is discarded.
+func (p *partialFile) Commit(check func(io.ReaderAt) error) error {
+	p.mu.Lock()
+	done := p.state.done()
+	p.mu.Unlock()
+
+	if uint64(done) != p.state.Size {
+		return errors.Errorf("partial file %s incomplete: %d != %d", p.path, done, p.state.Size)
+	}
+
+	if err := p.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync partial file")
+	}
+
+	stat, err := p.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat partial file")
+	}
+	if uint64(stat.Size()) != p.state.Size {
+		return errors.Errorf("partial file %s has %d bytes, expected %d", p.path, stat.Size(), p.state.Size)
+	}
+
+	if check != nil {
+		if err := check(p.file); err != nil {
+			p.Discard()
+			return err
+		}
+	}
+
+	if err := os.Rename(p.path, p.finalPath); err != nil {
+		return errors.Wrap(err, "failed to rename partial file")
+	}
+
+	if err := os.Remove(p.statePath); err != nil && !os.IsNotExist(err) {
+		p.log.WARN.Printf("failed to remove partial state %q: %s", p.statePath, err)
+	}
+
+	return nil
+}
+
+func (p *partialFile) Close() error {
+	return p.file.Close()
+}
+
+// Discard removes the partial file and its state. It is used when a failed
+// download cannot be resumed.
+func (p *partialFile) Discard() {
+	for _, path := range []string{p.path, p.statePath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			p.log.WARN.Printf("failed to remove %q: %s", path, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// tcpDialer opens the TCP stream an ssh connection runs over.
+type tcpDialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// newProxyDialer returns a dialer that connects through the proxy at raw,
+// which may be a socks5://, socks5h:// or http:// URL with optional
+// credentials. As with curl, socks5 resolves host names locally and socks5h
+// leaves them to the proxy. An empty URL dials directly.
+func newProxyDialer(raw string) (tcpDialer, error) {
+	direct := &net.Dialer{}
+	if raw == "" {
+		return direct, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: missing host", raw)
+	}
+
+	switch u.Scheme {
+	case "socks5":
+		forward, err := proxy.FromURL(u, direct)
+		if err != nil {
+			return nil, err
+		}
+		return &resolvingDialer{forward: forward}, nil
+	case "socks5h":
+		return proxy.FromURL(u, direct)
+	case "http":
+		return &httpConnectDialer{proxy: u, forward: direct}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// resolvingDialer resolves host names before handing the address to a
+// proxy, which x/net/proxy otherwise sends as is for both socks schemes.
+type resolvingDialer struct {
+	forward tcpDialer
+}
+
+func (d *resolvingDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy: invalid address")
+	}
+	if net.ParseIP(host) == nil {
+		addrs, err := net.DefaultResolver.LookupHost(context.Background(), host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "proxy: error resolving %s", host)
+		}
+		addr = net.JoinHostPort(addrs[0], port)
+	}
+	return d.forward.Dial(network, addr)
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with the
+// CONNECT method.
+type httpConnectDialer struct {
+	proxy   *url.URL
+	forward tcpDialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial(network, d.proxy.Host)
+	if err != nil {
+		return nil, errors.Wrap(err, "proxy: dial error")
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "proxy: CONNECT write error")
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "proxy: CONNECT read error")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("proxy: CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	// the ssh server speaks first, so its banner may already be buffered
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// redactURL hides the password in a proxy url before it is logged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
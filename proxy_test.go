@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// socksRequest is the destination a client asked the stand-in proxy for.
+type socksRequest struct {
+	// 1 for IPv4, 3 for a domain name and 4 for IPv6
+	addrType byte
+	host     string
+	port     uint16
+}
+
+// serveSocks5 accepts one SOCKS5 CONNECT on l without authentication,
+// reports the requested destination on requests and greets the client
+// instead of connecting anywhere.
+func serveSocks5(t *testing.T, l net.Listener, requests chan<- socksRequest) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Errorf("accept: %s", err)
+		close(requests)
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Errorf("reading socks request: %s", err)
+		}
+		return buf
+	}
+
+	// version, methods
+	greeting := read(2)
+	read(int(greeting[1]))
+	conn.Write([]byte{5, 0})
+
+	// version, command, reserved, address type
+	header := read(4)
+	req := socksRequest{addrType: header[3]}
+	switch req.addrType {
+	case 1:
+		req.host = net.IP(read(net.IPv4len)).String()
+	case 3:
+		req.host = string(read(int(read(1)[0])))
+	case 4:
+		req.host = net.IP(read(net.IPv6len)).String()
+	default:
+		t.Errorf("unknown socks address type %d", req.addrType)
+	}
+	req.port = binary.BigEndian.Uint16(read(2))
+	requests <- req
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	conn.Write([]byte("SSH-2.0-stand-in\r\n"))
+}
+
+func TestProxyDialerSocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   string
+		addr     string
+		wantType byte
+		wantHost string
+	}{
+		{"socks5 resolves locally", "socks5", "localhost:22", 1, "127.0.0.1"},
+		{"socks5h resolves remotely", "socks5h", "localhost:22", 3, "localhost"},
+		{"socks5 with an address", "socks5", "192.0.2.1:22", 1, "192.0.2.1"},
+		{"socks5h with an address", "socks5h", "192.0.2.1:22", 1, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %s", err)
+			}
+			defer l.Close()
+
+			requests := make(chan socksRequest, 1)
+			go serveSocks5(t, l, requests)
+
+			dialer, err := newProxyDialer(tt.scheme + "://" + l.Addr().String())
+			if err != nil {
+				t.Fatalf("newProxyDialer: %s", err)
+			}
+			conn, err := dialer.Dial("tcp", tt.addr)
+			if err != nil {
+				t.Fatalf("Dial(%q): %s", tt.addr, err)
+			}
+			defer conn.Close()
+
+			req, ok := <-requests
+			if !ok {
+				t.FailNow()
+			}
+			host := req.host
+			if tt.wantType == 1 && req.addrType == 4 && net.ParseIP(host).IsLoopback() {
+				// localhost may resolve to ::1 first
+				host = "127.0.0.1"
+			} else if req.addrType != tt.wantType {
+				t.Errorf("address type = %d, want %d", req.addrType, tt.wantType)
+			}
+			if host != tt.wantHost || req.port != 22 {
+				t.Errorf("proxy was asked for %s port %d, want %s port 22", req.host, req.port, tt.wantHost)
+			}
+
+			banner, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || banner != "SSH-2.0-stand-in\r\n" {
+				t.Errorf("read %q, %v through the proxy", banner, err)
+			}
+		})
+	}
+}
+
+func TestProxyDialerInvalid(t *testing.T) {
+	for _, raw := range []string{"socks4://proxy:1080", "socks5://", "://bad"} {
+		if _, err := newProxyDialer(raw); err == nil {
+			t.Errorf("newProxyDialer(%q) succeeded", raw)
+		}
+	}
+}
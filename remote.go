@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/pool"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+const (
+	transportSSH   = "ssh"
+	transportLocal = "local"
+)
+
+var (
+	_ remoteHost = (*sshRemote)(nil)
+	_ remoteHost = localRemote{}
+)
+
+// remoteHost is the machine the torrent client and its files live on. It is
+// either reached over ssh or, when seedbox-sync runs on the seedbox itself,
+// used directly.
+type remoteHost interface {
+	// FS returns the filesystem used for metadata and small reads.
+	FS() (remoteFS, error)
+	// Transfer returns a filesystem for one bulk transfer that is
+	// interrupted when ctx is done. release must be called with the
+	// transfer's result once it is finished.
+	Transfer(ctx context.Context, log pool.Printer) (fs remoteFS, release func(error), err error)
+	// Dial connects to an address as seen from the remote host.
+	Dial(network, addr string) (net.Conn, error)
+	// Run runs a shell command and returns its standard output.
+	Run(ctx context.Context, cmd string, stderr io.Writer) ([]byte, error)
+	Close()
+}
+
+// remoteFile is an open file on the remote host.
+type remoteFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// remoteFS is the part of a filesystem seedbox-sync reads from.
+type remoteFS interface {
+	Open(path string) (remoteFile, error)
+	Stat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	// Walk calls fn for root and everything below it. Symbolic links are
+	// reported but not followed.
+	Walk(root string, fn func(path string, info os.FileInfo) error) error
+}
+
+func (c *Config) newRemoteHost(log logging.Notepad) (remoteHost, error) {
+	if c.Remote.Transport == transportLocal {
+		log.DEBUG.Println("Using the local filesystem")
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("error getting user home directory: %w", err)
+		}
+		return localRemote{home}, nil
+	}
+
+	sftpClientPool := pool.NewPool(
+		func(log pool.Printer) (*pooledSftpClient, error) {
+			return newPooledSftpClient(c, log)
+		},
+		pool.OptionDropItem(func(conn *pooledSftpClient) {
+			conn.sshClient.Close()
+		}),
+		pool.OptionMaxIdle[*pooledSftpClient](c.Local.DownloadThreads),
+		pool.OptionMaxIdleTime[*pooledSftpClient](time.Minute),
+		pool.OptionDebug[*pooledSftpClient](log.TRACE),
+	)
+
+	host := &sshRemote{
+		pool:       sftpClientPool,
+		supervisor: newSSHSupervisor(log, sftpClientPool),
+	}
+	if _, err := host.supervisor.Client(); err != nil {
+		host.Close()
+		return nil, err
+	}
+	return host, nil
+}
+
+// sshRemote reaches the remote host over ssh. Bulk transfers each get their
+// own pooled connection so they do not stall the control connection.
+type sshRemote struct {
+	pool       *pool.Pool[*pooledSftpClient]
+	supervisor *sshSupervisor
+}
+
+func (h *sshRemote) FS() (remoteFS, error) {
+	sftpClient, err := h.supervisor.SFTP()
+	if err != nil {
+		return nil, err
+	}
+	return sftpFS{sftpClient}, nil
+}
+
+func (h *sshRemote) Transfer(ctx context.Context, log pool.Printer) (remoteFS, func(error), error) {
+	conn, err := h.pool.Get(log)
+	if err != nil {
+		return nil, nil, errors.Wrap(connectionError{err}, "failed to dial ssh connection")
+	}
+
+	// closing the connection is the only way to interrupt a stalled read
+	stop := closeOnDone(ctx, conn.sshClient)
+	release := func(err error) {
+		stop()
+		h.release(conn, err)
+	}
+	return sftpFS{conn.sftpClient}, release, nil
+}
+
+// release returns a pooled connection, or drops it if err suggests the
+// connection itself is broken.
+func (h *sshRemote) release(conn *pooledSftpClient, err error) {
+	// a cancelled transfer has already had its connection closed under it
+	cancelled := errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	if err != nil && (cancelled || !isPermanent(err)) {
+		h.pool.Drop(conn)
+		return
+	}
+	h.pool.Put(conn)
+}
+
+func (h *sshRemote) Dial(network, addr string) (net.Conn, error) {
+	client, err := h.supervisor.SSH()
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial(network, addr)
+}
+
+func (h *sshRemote) Run(ctx context.Context, cmd string, stderr io.Writer) ([]byte, error) {
+	client, err := h.supervisor.SSH()
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(connectionError{err}, "failed to create new ssh session")
+	}
+	defer sess.Close()
+	defer closeOnDone(ctx, sess)()
+
+	sess.Stderr = stderr
+	return sess.Output(cmd)
+}
+
+func (h *sshRemote) Close() {
+	h.supervisor.Close()
+	h.pool.Close()
+}
+
+// localRemote is used when seedbox-sync runs on the seedbox, or next to the
+// torrent client with its download directory mounted. Relative paths are
+// relative to the home directory, as they are over ssh, rather than to the
+// working directory.
+type localRemote struct {
+	home string
+}
+
+func (h localRemote) FS() (remoteFS, error) {
+	return localFS{h.home}, nil
+}
+
+func (h localRemote) Transfer(ctx context.Context, log pool.Printer) (remoteFS, func(error), error) {
+	return localFS{h.home}, func(error) {}, nil
+}
+
+func (h localRemote) Dial(network, addr string) (net.Conn, error) {
+	if network == "unix" {
+		addr = resolveHome(h.home, addr)
+	}
+	return net.Dial(network, addr)
+}
+
+func (h localRemote) Run(ctx context.Context, cmd string, stderr io.Writer) ([]byte, error) {
+	c := exec.CommandContext(ctx, "sh", "-c", cmd)
+	c.Dir = h.home
+	c.Stderr = stderr
+	return c.Output()
+}
+
+func (localRemote) Close() {}
+
+type sftpFS struct {
+	client *sftp.Client
+}
+
+func (fs sftpFS) Open(path string) (remoteFile, error) {
+	f, err := fs.client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs sftpFS) Stat(path string) (os.FileInfo, error) {
+	return fs.client.Stat(path)
+}
+
+func (fs sftpFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return fs.client.ReadDir(path)
+}
+
+func (fs sftpFS) Walk(root string, fn func(path string, info os.FileInfo) error) error {
+	walker := fs.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return errors.Wrapf(err, "failed to walk %s", walker.Path())
+		}
+		if err := fn(walker.Path(), walker.Stat()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveHome joins a relative path onto home. Absolute paths, and Linux
+// abstract socket names starting with "@", are returned as is.
+func resolveHome(home, path string) string {
+	if home == "" || path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "@") {
+		return path
+	}
+	return filepath.Join(home, path)
+}
+
+type localFS struct {
+	home string
+}
+
+func (fs localFS) Open(path string) (remoteFile, error) {
+	f, err := os.Open(resolveHome(fs.home, path))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs localFS) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(resolveHome(fs.home, path))
+}
+
+func (fs localFS) ReadDir(path string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(resolveHome(fs.home, path))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// removed since the directory was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (fs localFS) Walk(root string, fn func(path string, info os.FileInfo) error) error {
+	resolved := resolveHome(fs.home, root)
+	return filepath.Walk(resolved, func(path string, info os.FileInfo, err error) error {
+		// report the paths below root as given, the same as sftp
+		path = root + strings.TrimPrefix(path, resolved)
+		if err != nil {
+			return errors.Wrapf(err, "failed to walk %s", path)
+		}
+		return fn(path, info)
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type RetryPolicy struct {
+	Attempts       int           `toml:"attempts,omitempty"`
+	InitialBackoff time.Duration `toml:"initial-backoff,omitempty"`
+	MaxBackoff     time.Duration `toml:"max-backoff,omitempty"`
+	Multiplier     float64       `toml:"multiplier,omitempty"`
+	// fraction of each backoff that is randomized, between 0 and 1
+	Jitter float64 `toml:"jitter,omitempty"`
+}
+
+func (p *RetryPolicy) setDefaults(attempts int) {
+	if p.Attempts <= 0 {
+		p.Attempts = attempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Minute
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = 0.2
+	}
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+		if d >= float64(p.MaxBackoff) {
+			d = float64(p.MaxBackoff)
+			break
+		}
+	}
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// do runs fn until it succeeds, fails permanently or runs out of attempts.
+func (p *RetryPolicy) do(ctx context.Context, log logging.Notepad, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := p.backoff(attempt)
+		log.WARN.Printf("attempt %d of %d failed, retrying in %s: %s", attempt, p.Attempts, wait.Round(time.Millisecond), err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// isPermanent reports whether retrying err cannot help.
+func isPermanent(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrNotExist),
+		errors.Is(err, os.ErrPermission),
+		errors.Is(err, syscall.ENOSPC),
+		errors.Is(err, syscall.EDQUOT),
+		errors.Is(err, syscall.EROFS):
+		return true
+	}
+
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		switch status.FxCode() {
+		case sftp.ErrSSHFxNoSuchFile, sftp.ErrSSHFxPermissionDenied, sftp.ErrSSHFxOpUnsupported:
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRetryable reports whether err looks like a transient network failure.
+func isRetryable(err error) bool {
+	if err == nil || isPermanent(err) {
+		return false
+	}
+
+	var netErr net.Error
+	var chanErr *ssh.OpenChannelError
+	var exitMissing *ssh.ExitMissingError
+	switch {
+	case errors.As(err, &netErr),
+		errors.As(err, &chanErr),
+		errors.As(err, &exitMissing),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, sftp.ErrSSHFxConnectionLost),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ETIMEDOUT):
+		return true
+	}
+
+	var conn connectionError
+	return errors.As(err, &conn)
+}
+
+// connectionError marks a failed ssh connection, which is always retryable.
+type connectionError struct {
+	err error
+}
+
+func (e connectionError) Error() string { return e.err.Error() }
+func (e connectionError) Unwrap() error { return e.err }
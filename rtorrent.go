@@ -1,23 +1,116 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"time"
 
 	"github.com/demosdemon/seedbox-sync/lib/logging"
-	"github.com/mrobinsn/go-rtorrent/rtorrent"
-	"golang.org/x/crypto/ssh"
+	"github.com/demosdemon/seedbox-sync/lib/rtorrent"
+	"github.com/demosdemon/seedbox-sync/lib/scgi"
+	"github.com/pkg/errors"
 )
 
-func (c *Config) RTorrentClient(log logging.Notepad, ssh *ssh.Client) *rtorrent.RTorrent {
-	httpClient := &http.Client{
-		Transport: scgiProxy{
-			dial: func() (net.Conn, error) {
-				log.TRACE.Printf("Connecting to %s via SSH", c.Remote.Rtorrent.Socket)
-				return ssh.Dial("unix", c.Remote.Rtorrent.Socket)
+const (
+	schemeSCGIUnix = "scgi+unix"
+	schemeSCGITCP  = "scgi+tcp"
+)
+
+// rtorrentHTTPClient returns a client for the configured rtorrent endpoint.
+// SCGI endpoints are dialed from the remote host, which is through the ssh
+// connection unless remote.transport is local; HTTP endpoints are dialed
+// directly, so ssh is only needed for file transfer.
+func (c *Config) rtorrentHTTPClient(log logging.Notepad, remote remoteHost) (*http.Client, error) {
+	cfg := &c.Remote.Rtorrent
+	switch cfg.url.Scheme {
+	case schemeSCGIUnix, schemeSCGITCP:
+		network, addr := "unix", scgiSocketPath(cfg.url)
+		if cfg.url.Scheme == schemeSCGITCP {
+			network, addr = "tcp", cfg.url.Host
+		}
+		return &http.Client{
+			Transport: &scgi.Transport{
+				Dial: func() (net.Conn, error) {
+					log.TRACE.Printf("Connecting to %s", addr)
+					return remote.Dial(network, addr)
+				},
 			},
-		},
+		}, nil
+
+	default:
+		tlsConfig, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+
+		var rt http.RoundTripper = transport
+		if cfg.Username != "" {
+			rt = basicAuthTransport{rt, cfg.Username, cfg.Password}
+		}
+		return &http.Client{Transport: rt, Timeout: time.Minute}, nil
+	}
+}
+
+// scgiSocketPath returns the socket of a scgi+unix URL. A path without a
+// leading slash, as in scgi+unix://rpc.socket, is relative to the remote
+// home directory.
+func scgiSocketPath(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// tlsConfig adds the configured CA and client certificate to the defaults.
+func (c *RtorrentConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "rtorrent: error reading ca-file")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("rtorrent: no certificates found in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
 	}
 
-	return rtorrent.New("", false).WithHTTPClient(httpClient)
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "rtorrent: error loading client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+type basicAuthTransport struct {
+	rt       http.RoundTripper
+	username string
+	password string
+}
+
+func (t basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, t.password)
+	return t.rt.RoundTrip(req)
+}
+
+// RtorrentClient returns a client for the configured rtorrent endpoint.
+func (c *Config) RtorrentClient(log logging.Notepad, remote remoteHost) (*rtorrent.Client, error) {
+	client, err := c.rtorrentHTTPClient(log, remote)
+	if err != nil {
+		return nil, err
+	}
+	return rtorrent.New(c.Remote.Rtorrent.url.String(), client), nil
 }
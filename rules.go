@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"time"
+)
+
+const (
+	actionInclude = "include"
+	actionExclude = "exclude"
+)
+
+// RuleConfig selects torrents to include or exclude. Every condition that is
+// set must match; the first matching rule decides and torrents that match no
+// rule are included.
+type RuleConfig struct {
+	Action string `toml:"action"`
+	// glob matched against the rtorrent label
+	Label string `toml:"label,omitempty"`
+	// glob matched against the host of any of the torrent's trackers
+	Tracker string `toml:"tracker,omitempty"`
+	// regular expression matched against the torrent name
+	Name    string        `toml:"name,omitempty"`
+	MinSize byteSize      `toml:"min-size,omitempty"`
+	MaxSize byteSize      `toml:"max-size,omitempty"`
+	MinAge  time.Duration `toml:"min-age,omitempty"`
+	MaxAge  time.Duration `toml:"max-age,omitempty"`
+	// destination template for torrents included by this rule
+	Destination string `toml:"destination,omitempty"`
+
+	name *regexp.Regexp
+}
+
+func (c *RuleConfig) setDefaults(idx int) error {
+	switch c.Action {
+	case actionInclude, actionExclude:
+	default:
+		return fmt.Errorf("rule[%d].action must be %q or %q", idx, actionInclude, actionExclude)
+	}
+
+	for _, glob := range []string{c.Label, c.Tracker} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("rule[%d]: invalid pattern %q: %w", idx, glob, err)
+		}
+	}
+
+	if err := validateDestination(c.Destination); err != nil {
+		return fmt.Errorf("rule[%d].destination: %w", idx, err)
+	}
+
+	if c.Name != "" {
+		re, err := regexp.Compile(c.Name)
+		if err != nil {
+			return fmt.Errorf("rule[%d].name: %w", idx, err)
+		}
+		c.name = re
+	}
+
+	return nil
+}
+
+func (c *RuleConfig) matches(torrent torrentInfo, trackers func() ([]string, error)) (bool, error) {
+	if c.Label != "" {
+		if ok, _ := path.Match(c.Label, torrent.Label); !ok {
+			return false, nil
+		}
+	}
+
+	if c.name != nil && !c.name.MatchString(torrent.Name) {
+		return false, nil
+	}
+
+	if c.MinSize > 0 && torrent.Size < int64(c.MinSize) {
+		return false, nil
+	}
+
+	if c.MaxSize > 0 && torrent.Size > int64(c.MaxSize) {
+		return false, nil
+	}
+
+	age := time.Since(torrent.Finished)
+	if c.MinAge > 0 && age < c.MinAge {
+		return false, nil
+	}
+
+	if c.MaxAge > 0 && age > c.MaxAge {
+		return false, nil
+	}
+
+	if c.Tracker != "" {
+		urls, err := trackers()
+		if err != nil {
+			return false, err
+		}
+		if !anyTrackerMatches(c.Tracker, urls) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func anyTrackerMatches(glob string, urls []string) bool {
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		if ok, _ := path.Match(glob, u.Hostname()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectTorrent applies the configured rules to a torrent. It returns whether
+// the torrent should be synced and the index of the deciding rule, or -1 if
+// no rule matched. Trackers are only fetched if a rule needs them.
+func (c *Config) selectTorrent(torrent torrentInfo, trackers func() ([]string, error)) (bool, int, error) {
+	for idx := range c.Rules {
+		rule := &c.Rules[idx]
+		ok, err := rule.matches(torrent, trackers)
+		if err != nil {
+			return false, idx, err
+		}
+		if ok {
+			return rule.Action == actionInclude, idx, nil
+		}
+	}
+
+	return true, -1, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// handleSignals begins a graceful shutdown on SIGINT or SIGTERM: no new work
+// is accepted, and in-flight work is cancelled once the shutdown timeout
+// passes or a second signal arrives.
+func (unit *sharedUnit) handleSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-ch
+		if s, ok := sig.(syscall.Signal); ok {
+			unit.exitCode.Store(128 + int32(s))
+		}
+
+		timeout := unit.config.ShutdownTimeout
+		unit.log.WARN.Printf("Received %s, shutting down; in-flight work has %s to finish", sig, timeout)
+		unit.stop()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case sig := <-ch:
+			unit.log.WARN.Printf("Received %s again, cancelling in-flight work", sig)
+		case <-timer.C:
+			unit.log.WARN.Println("Shutdown timeout passed, cancelling in-flight work")
+		}
+		unit.abort()
+		signal.Stop(ch)
+	}()
+}
+
+// closeOnDone closes c if ctx is done before the returned function is called.
+// It is used to interrupt blocking network calls that do not take a context.
+func closeOnDone(ctx context.Context, c interface{ Close() error }) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// contextReader fails reads once ctx is done so that long copies can be
+// interrupted between chunks.
+type contextReader struct {
+	ctx context.Context
+	r   interface{ Read([]byte) (int, error) }
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
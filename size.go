@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeSuffixes = []struct {
+	suffix string
+	shift  uint
+}{
+	{"TiB", 40}, {"GiB", 30}, {"MiB", 20}, {"KiB", 10},
+	{"TB", 40}, {"GB", 30}, {"MB", 20}, {"KB", 10},
+	{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10},
+	{"B", 0},
+}
+
+// byteSize is a number of bytes that may be written in the config as an
+// integer or as a string with a binary suffix, e.g. "512MiB" or "4G".
+type byteSize int64
+
+func (s *byteSize) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case int64:
+		*s = byteSize(v)
+		return nil
+	case string:
+		size, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+		*s = size
+		return nil
+	default:
+		return fmt.Errorf("invalid size %v: expected an integer or a string", v)
+	}
+}
+
+func parseByteSize(str string) (byteSize, error) {
+	str = strings.TrimSpace(str)
+	for _, unit := range sizeSuffixes {
+		if num, ok := strings.CutSuffix(str, unit.suffix); ok {
+			n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size %q", str)
+			}
+			return byteSize(n * float64(int64(1)<<unit.shift)), nil
+		}
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", str)
+	}
+	return byteSize(n), nil
+}
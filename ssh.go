@@ -1,8 +1,7 @@
 package main
 
 import (
-	"fmt"
-	"os"
+	"time"
 
 	"github.com/demosdemon/seedbox-sync/lib/pool"
 	"github.com/pkg/errors"
@@ -10,28 +9,135 @@ import (
 )
 
 func (c *Config) DialSSH(log pool.Printer) (*ssh.Client, error) {
-	privateKey, err := os.ReadFile(c.Remote.Ssh.KeyFile)
+	auth, err := c.Remote.Ssh.authMethod(log)
 	if err != nil {
-		return nil, errors.Wrap(err, "ssh: error reading private key")
+		return nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(privateKey)
+	// each jump host is dialed through the previous one
+	var via *ssh.Client
+	for _, jump := range c.Remote.Ssh.jumps {
+		client, err := c.Remote.Ssh.dialHost(log, via, jump, auth)
+		if err != nil {
+			if via != nil {
+				via.Close()
+			}
+			return nil, err
+		}
+		via = client
+	}
+
+	target := sshHost{
+		hostname: c.Remote.Ssh.Hostname,
+		port:     c.Remote.Ssh.Port,
+		user:     c.Remote.Ssh.Username,
+	}
+	client, err := c.Remote.Ssh.dialHost(log, via, target, auth)
 	if err != nil {
-		return nil, errors.Wrap(err, "ssh: error parsing private key")
+		if via != nil {
+			via.Close()
+		}
+		return nil, err
 	}
 
-	auth := ssh.PublicKeys(signer)
+	c.Remote.Ssh.keepalive(log, client)
+	return client, nil
+}
 
+func (c *SshConfig) dialHost(log pool.Printer, via *ssh.Client, host sshHost, auth ssh.AuthMethod) (*ssh.Client, error) {
+	addr := host.addr()
 	sshConfig := ssh.ClientConfig{
-		User: c.Remote.Ssh.Username,
-		Auth: []ssh.AuthMethod{auth},
-		// TODO: This is insecure, but I don't care for now.
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		BannerCallback:  ssh.BannerDisplayStderr(),
+		User:              host.user,
+		Auth:              []ssh.AuthMethod{auth},
+		HostKeyCallback:   c.hostKeyCallback(log),
+		HostKeyAlgorithms: c.hostKeyAlgorithms(addr),
+		BannerCallback:    ssh.BannerDisplayStderr(),
+	}
+
+	var dialer tcpDialer = c.proxyDialer
+	switch {
+	case via != nil:
+		log.Printf("Connecting to %s via %s", addr, via.RemoteAddr())
+		dialer = via
+	case c.Proxy != "":
+		log.Printf("Connecting to %s via proxy %s", addr, redactURL(c.Proxy))
+	default:
+		log.Printf("Connecting to %s", addr)
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ssh: error dialing %s", addr)
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client := ssh.NewClient(clientConn, chans, reqs)
+	if via == nil {
+		return client, nil
 	}
 
-	addr := fmt.Sprintf("%s:%d", c.Remote.Ssh.Hostname, c.Remote.Ssh.Port)
+	go func() {
+		// the jump host connection only lives as long as the one through it
+		client.Wait()
+		via.Close()
+	}()
+	return client, nil
+}
+
+// keepalive sends a request every ServerAliveInterval and closes the
+// client once ServerAliveCountMax requests in a row go unanswered, the
+// same as ssh(1).
+func (c *SshConfig) keepalive(log pool.Printer, client *ssh.Client) {
+	if c.ServerAliveInterval <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(c.ServerAliveInterval)
+		defer ticker.Stop()
+
+		missed := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+
+			select {
+			case <-done:
+				return
+			case err := <-reply:
+				if err == nil {
+					missed = 0
+					continue
+				}
+			case <-time.After(c.ServerAliveInterval):
+			}
 
-	log.Printf("Connecting to %s", addr)
-	return ssh.Dial("tcp", addr, &sshConfig)
+			missed++
+			if missed >= c.ServerAliveCountMax {
+				log.Printf("Timeout, server %s not responding", client.RemoteAddr())
+				client.Close()
+				return
+			}
+		}
+	}()
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/demosdemon/seedbox-sync/lib/pool"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+// sshAuth holds the credentials shared by every ssh connection. Keys are
+// loaded once so that a passphrase is asked for at most once per run.
+type sshAuth struct {
+	once    sync.Once
+	agent   agent.ExtendedAgent
+	signers []ssh.Signer
+	err     error
+}
+
+// authMethod returns a single public key method that offers the agent's
+// keys first and then the configured key files. The ssh client tries each
+// method type only once, so all keys must be offered by the same method.
+func (c *SshConfig) authMethod(log pool.Printer) (ssh.AuthMethod, error) {
+	c.auth.once.Do(func() {
+		c.auth.err = c.loadAuth(log)
+	})
+	if c.auth.err != nil {
+		return nil, c.auth.err
+	}
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		if c.auth.agent != nil {
+			agentSigners, err := c.auth.agent.Signers()
+			if err != nil {
+				log.Printf("Error listing ssh-agent keys: %s", err)
+			}
+			signers = append(signers, agentSigners...)
+		}
+		return append(signers, c.auth.signers...), nil
+	}), nil
+}
+
+func (c *SshConfig) loadAuth(log pool.Printer) error {
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" && !c.DisableAgent {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			log.Printf("Error connecting to ssh-agent at %s: %s", sock, err)
+		} else {
+			log.Printf("Using ssh-agent at %s", sock)
+			c.auth.agent = agent.NewClient(conn)
+		}
+	}
+
+	for _, path := range c.KeyFiles {
+		signer, err := c.loadKey(path)
+		if err != nil {
+			log.Printf("Skipping private key %s: %s", path, err)
+			continue
+		}
+		c.auth.signers = append(c.auth.signers, signer)
+	}
+
+	if c.auth.agent == nil && len(c.auth.signers) == 0 {
+		return errors.New("ssh: no usable private keys and no ssh-agent")
+	}
+	return nil
+}
+
+func (c *SshConfig) loadKey(path string) (ssh.Signer, error) {
+	privateKey, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "ssh: error reading private key")
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, errors.Wrap(err, "ssh: error parsing private key")
+	}
+
+	passphrase, err := c.passphrase(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, passphrase)
+	return signer, errors.Wrap(err, "ssh: error decrypting private key")
+}
+
+// passphrase finds the passphrase for an encrypted key in the environment,
+// then the passphrase file, and finally by prompting on the terminal.
+func (c *SshConfig) passphrase(path string) ([]byte, error) {
+	if c.PassphraseEnv != "" {
+		if passphrase, ok := os.LookupEnv(c.PassphraseEnv); ok {
+			return []byte(passphrase), nil
+		}
+	}
+
+	if c.PassphraseFile != "" {
+		data, err := os.ReadFile(c.PassphraseFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "ssh: error reading passphrase file")
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("ssh: private key is encrypted and no passphrase is available")
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for key %s: ", path)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, errors.Wrap(err, "ssh: error reading passphrase")
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// sshHost is a host to connect to after resolving ssh config aliases.
+type sshHost struct {
+	hostname string
+	port     uint16
+	user     string
+}
+
+func (h sshHost) addr() string {
+	return net.JoinHostPort(h.hostname, strconv.Itoa(int(h.port)))
+}
+
+// userSSHConfig is a parsed ssh_config(5) file. A nil *userSSHConfig has no
+// settings for any host.
+type userSSHConfig struct {
+	cfg *ssh_config.Config
+}
+
+func loadUserSSHConfig(path string) (*userSSHConfig, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening ssh config: %w", err)
+	}
+	defer f.Close()
+
+	cfg, err := ssh_config.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ssh config %s: %w", path, err)
+	}
+	return &userSSHConfig{cfg}, nil
+}
+
+func (u *userSSHConfig) get(alias, key string) string {
+	if u == nil {
+		return ""
+	}
+	value, _ := u.cfg.Get(alias, key)
+	return value
+}
+
+func (u *userSSHConfig) getAll(alias, key string) []string {
+	if u == nil {
+		return nil
+	}
+	values, _ := u.cfg.GetAll(alias, key)
+	return values
+}
+
+// resolve looks up the real host name, port and user for alias. Values set
+// explicitly by the caller take precedence over the ssh config.
+func (u *userSSHConfig) resolve(alias string, port uint16, user string) (sshHost, error) {
+	host := sshHost{hostname: alias, port: port, user: user}
+
+	if hostname := u.get(alias, "HostName"); hostname != "" {
+		host.hostname = strings.ReplaceAll(hostname, "%h", alias)
+	}
+
+	if host.port == 0 {
+		if value := u.get(alias, "Port"); value != "" {
+			p, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return host, fmt.Errorf("invalid Port %q for host %s in ssh config", value, alias)
+			}
+			host.port = uint16(p)
+		}
+	}
+
+	if host.user == "" {
+		host.user = u.get(alias, "User")
+	}
+
+	return host, nil
+}
+
+// applyUserSSHConfig fills in the unset ssh settings from the entry for
+// the configured host name, which may be a Host alias.
+func (c *SshConfig) applyUserSSHConfig(u *userSSHConfig) error {
+	alias := c.Hostname
+
+	host, err := u.resolve(alias, c.Port, c.Username)
+	if err != nil {
+		return err
+	}
+	c.Hostname = host.hostname
+	c.Port = host.port
+	c.Username = host.user
+
+	if len(c.KeyFiles) == 0 {
+		c.KeyFiles = u.getAll(alias, "IdentityFile")
+	}
+
+	if c.ProxyJump == "" {
+		c.ProxyJump = u.get(alias, "ProxyJump")
+	}
+
+	if c.ServerAliveInterval == 0 {
+		if value := u.get(alias, "ServerAliveInterval"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid ServerAliveInterval %q for host %s in ssh config", value, alias)
+			}
+			c.ServerAliveInterval = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if c.ServerAliveCountMax == 0 {
+		if value := u.get(alias, "ServerAliveCountMax"); value != "" {
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid ServerAliveCountMax %q for host %s in ssh config", value, alias)
+			}
+			c.ServerAliveCountMax = count
+		}
+	}
+
+	return nil
+}
+
+// parseProxyJump resolves a comma separated list of [user@]host[:port] jump
+// hosts, each of which may itself be an alias in the ssh config.
+func parseProxyJump(u *userSSHConfig, jumps string, defaultUser string) ([]sshHost, error) {
+	if jumps == "" || strings.EqualFold(jumps, "none") {
+		return nil, nil
+	}
+
+	var hosts []sshHost
+	for _, jump := range strings.Split(jumps, ",") {
+		jump = strings.TrimPrefix(strings.TrimSpace(jump), "ssh://")
+
+		var user string
+		if at := strings.LastIndexByte(jump, '@'); at >= 0 {
+			user, jump = jump[:at], jump[at+1:]
+		}
+
+		var port uint16
+		if hostname, portStr, err := net.SplitHostPort(jump); err == nil {
+			p, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in jump host %q", jump)
+			}
+			jump, port = hostname, uint16(p)
+		}
+
+		if jump == "" {
+			return nil, fmt.Errorf("invalid jump host in %q", jumps)
+		}
+
+		host, err := u.resolve(jump, port, user)
+		if err != nil {
+			return nil, err
+		}
+		if host.port == 0 {
+			host.port = 22
+		}
+		if host.user == "" {
+			host.user = defaultUser
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
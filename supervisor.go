@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/demosdemon/seedbox-sync/lib/logging"
+	"github.com/demosdemon/seedbox-sync/lib/pool"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSupervisor keeps the shared ssh connection, redialing it after a drop.
+type sshSupervisor struct {
+	log  logging.Notepad
+	pool *pool.Pool[*pooledSftpClient]
+
+	mu     sync.Mutex
+	conn   *pooledSftpClient
+	closed bool
+}
+
+func newSSHSupervisor(log logging.Notepad, pool *pool.Pool[*pooledSftpClient]) *sshSupervisor {
+	return &sshSupervisor{log: log, pool: pool}
+}
+
+// Client returns the current connection, dialing a new one if it dropped.
+func (s *sshSupervisor) Client() (*pooledSftpClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errors.New("ssh supervisor is closed")
+	}
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	s.log.DEBUG.Println("Dialing control connection")
+	conn, err := s.pool.Get(s.log.DEBUG)
+	if err != nil {
+		s.log.ERROR.Printf("Error dialing control connection: %s", err)
+		return nil, connectionError{err}
+	}
+	s.conn = conn
+
+	go s.watch(conn)
+	return conn, nil
+}
+
+// SSH returns a healthy ssh client.
+func (s *sshSupervisor) SSH() (*ssh.Client, error) {
+	conn, err := s.Client()
+	if err != nil {
+		return nil, err
+	}
+	return conn.sshClient, nil
+}
+
+// SFTP returns a healthy sftp client.
+func (s *sshSupervisor) SFTP() (*sftp.Client, error) {
+	conn, err := s.Client()
+	if err != nil {
+		return nil, err
+	}
+	return conn.sftpClient, nil
+}
+
+// watch forgets conn once it closes.
+func (s *sshSupervisor) watch(conn *pooledSftpClient) {
+	err := conn.sshClient.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == conn {
+		s.conn = nil
+		if !s.closed {
+			s.log.WARN.Printf("Control connection lost, reconnecting on next use: %v", err)
+		}
+	}
+}
+
+func (s *sshSupervisor) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.conn != nil {
+		s.conn.sshClient.Close()
+		s.conn = nil
+	}
+}
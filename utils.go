@@ -1,15 +1,25 @@
 package main
 
-import "github.com/pkg/errors"
+import (
+	"context"
 
-func ExactChannel[T any](ch <-chan T, count int) ([]T, error) {
+	"github.com/pkg/errors"
+)
+
+// ExactChannel receives count values from ch. It gives up early if the
+// channel is closed or ctx is done.
+func ExactChannel[T any](ctx context.Context, ch <-chan T, count int) ([]T, error) {
 	result := make([]T, 0, count)
 	for i := 0; i < count; i++ {
-		v, ok := <-ch
-		if !ok {
-			return result, errors.New("channel closed")
+		select {
+		case v, ok := <-ch:
+			if !ok {
+				return result, errors.New("channel closed")
+			}
+			result = append(result, v)
+		case <-ctx.Done():
+			return result, ctx.Err()
 		}
-		result = append(result, v)
 	}
 	return result, nil
 }